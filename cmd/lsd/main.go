@@ -0,0 +1,203 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Command lsd works with LSD documents from the command line.
+//
+// Usage:
+//
+//	lsd validate -schema schema.lsd [file ...]
+//	lsd gen-go [-package name] [-type name] sample.lsd [sample.lsd ...]
+//	lsd gen-methods -type name[,name...] [-output file] [dir]
+//
+// gen-methods is meant to be run by go generate, with a directive like:
+//
+//	//go:generate lsd gen-methods -type Config,User
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gdelugre/lsd"
+	"github.com/gdelugre/lsd/internal/gen"
+)
+
+// Subcommands, by name.
+var commands = map[string]func(args []string) int{
+	"validate":    validate,
+	"gen-go":      genGo,
+	"gen-methods": genMethods,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: lsd <command> [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  validate -schema FILE [FILE ...]  check documents against a schema\n")
+	fmt.Fprintf(os.Stderr, "  gen-go [-package NAME] [-type NAME] FILE [FILE ...]\n")
+	fmt.Fprintf(os.Stderr, "                                    generate Go structures from sample documents\n")
+	fmt.Fprintf(os.Stderr, "  gen-methods -type NAME[,NAME...] [-output FILE] [DIR]\n")
+	fmt.Fprintf(os.Stderr, "                                    generate decoding methods without reflection\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	os.Exit(command(os.Args[2:]))
+}
+
+// Reads a file, or the standard input if the path is "-".
+func readInput(path string) (string, error) {
+	var (
+		bytes []byte
+		err   error
+	)
+	if path == "-" {
+		bytes, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		bytes, err = ioutil.ReadFile(path)
+	}
+	return string(bytes), err
+}
+
+// Prints an error, prefixed by the file name.
+// Schema violations are also prefixed by their position, in the format used by compilers.
+func report(path string, err error) {
+	if verr, ok := err.(*lsd.ValidationError); ok && verr.Pos.Line != 0 {
+		fmt.Printf("%s:%d:%d: %s\n", path, verr.Pos.Line, verr.Pos.Column, verr.Message)
+	} else {
+		fmt.Printf("%s: %s\n", path, err)
+	}
+}
+
+// Checks documents against a schema, reporting every violation with its position.
+// Documents are read from the standard input if no file is given.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "schema file")
+	flags.Parse(args)
+
+	if *schemaPath == "" {
+		fmt.Fprintf(os.Stderr, "lsd validate: missing -schema flag\n")
+		return 2
+	}
+
+	schema, err := lsd.LoadSchema(*schemaPath)
+	if err != nil {
+		report(*schemaPath, err)
+		return 2
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	status := 0
+	for _, path := range paths {
+		data, err := readInput(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "lsd validate: %s\n", err)
+			status = 2
+			continue
+		}
+
+		doc, err := lsd.Parse(data)
+		if err == nil {
+			err = lsd.Validate(doc, schema)
+		}
+
+		if errs, ok := err.(lsd.ValidationErrors); ok {
+			for _, err := range errs {
+				report(path, err)
+			}
+		} else if err != nil {
+			report(path, err)
+		}
+
+		if err != nil && status == 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// Prints the Go structures inferred from sample documents.
+func genGo(args []string) int {
+	flags := flag.NewFlagSet("gen-go", flag.ExitOnError)
+	pkg := flags.String("package", "main", "package of the generated code")
+	typeName := flags.String("type", "Config", "name of the root structure")
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	var docs []lsd.Node
+	for _, path := range paths {
+		data, err := readInput(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "lsd gen-go: %s\n", err)
+			return 2
+		}
+
+		doc, err := lsd.Parse(data)
+		if err != nil {
+			report(path, err)
+			return 1
+		}
+		docs = append(docs, doc)
+	}
+
+	code, err := gen.GenerateGo(*pkg, *typeName, docs...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lsd gen-go: %s\n", err)
+		return 1
+	}
+
+	os.Stdout.Write(code)
+	return 0
+}
+
+// Writes the UnmarshalLSD and MarshalLSD methods of structure types declared
+// in the package of a directory, the current one by default.
+func genMethods(args []string) int {
+	flags := flag.NewFlagSet("gen-methods", flag.ExitOnError)
+	types := flags.String("type", "", "comma-separated list of structure types")
+	output := flags.String("output", "lsd_methods.go", "output file, relative to the package directory")
+	flags.Parse(args)
+
+	if *types == "" {
+		fmt.Fprintf(os.Stderr, "lsd gen-methods: missing -type flag\n")
+		return 2
+	}
+
+	dir := "."
+	if flags.NArg() > 0 {
+		dir = flags.Arg(0)
+	}
+
+	code, err := gen.GenerateMethods(dir, strings.Split(*types, ",")...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lsd gen-methods: %s\n", err)
+		return 1
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, *output), code, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "lsd gen-methods: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,465 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gdelugre/lsd/internal/naming"
+)
+
+// Interface implemented by types packing themselves into a string.
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// Rational numbers, encoded as decimals when possible.
+var ratType = reflect.TypeOf(big.Rat{})
+
+// Returns the LSD document describing a structure.
+// Fields are written by name, following the conventions used by Load.
+func Marshal(v interface{}) ([]byte, error) {
+	st, ok := indirect(reflect.ValueOf(v))
+	if !ok || st.Kind() != reflect.Struct {
+		return nil, errors.New("lsd: Marshal expects a struct or a non-nil pointer to a struct")
+	}
+
+	// Values implementing encoding.TextMarshaler on pointers require addressable fields.
+	if !st.CanAddr() {
+		v := reflect.New(st.Type()).Elem()
+		v.Set(st)
+		st = v
+	}
+
+	rootNode := selfNode{root: true, head: selfString{str: "root"}}
+	if value, ok, err := marshalLSD(st); ok {
+		if err != nil {
+			return nil, err
+		} else if node, isList := value.(*selfNode); isList {
+			rootNode.values = node.values
+		} else {
+			return nil, errors.New("lsd: MarshalLSD of a document must return a list")
+		}
+	} else if rootNode.values, err = encodeStructFields(st); err != nil {
+		return nil, err
+	}
+
+	return []byte(rootNode.Dump(0)), nil
+}
+
+// Follows pointers and interfaces down to the concrete value.
+// Returns false if a nil value is encountered.
+func indirect(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
+}
+
+// Encodes a value with its MarshalText method, if it implements encoding.TextMarshaler.
+// Returns false if the value does not implement the interface.
+func marshalText(v reflect.Value) (str string, ok bool, err error) {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return
+	}
+
+	switch v.Type() {
+	case ratType:
+		r := new(big.Rat)
+		reflect.ValueOf(r).Elem().Set(v)
+		return formatRat(r), true, nil
+	case reflect.PtrTo(ratType):
+		return formatRat(v.Interface().(*big.Rat)), true, nil
+	}
+
+	if !v.Type().Implements(textMarshalerType) {
+		if !v.CanAddr() || !reflect.PtrTo(v.Type()).Implements(textMarshalerType) {
+			return
+		}
+		v = v.Addr()
+	}
+
+	text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+	return string(text), true, err
+}
+
+// Formats a rational number as a decimal when it has a finite decimal
+// expansion, like 1.25, or as a fraction like 1/3 otherwise.
+func formatRat(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+
+	// The expansion is finite if the denominator is a product of powers of 2
+	// and 5, the number of decimals being the largest exponent.
+	denom := new(big.Int).Set(r.Denom())
+	twos := denom.TrailingZeroBits()
+	denom.Rsh(denom, twos)
+
+	fives := uint(float64(denom.BitLen()-1)/math.Log2(5) + 0.5)
+	if new(big.Int).Exp(big.NewInt(5), big.NewInt(int64(fives)), nil).Cmp(denom) != 0 {
+		return r.String()
+	} else if fives > twos {
+		return r.FloatString(int(fives))
+	}
+	return r.FloatString(int(twos))
+}
+
+// Encodes the value held by an interface as a list headed by the name its
+// concrete type was registered under.
+// Returns false if the value is not an interface holding a registered type.
+func encodeVariant(v reflect.Value) (node *selfNode, ok bool, err error) {
+	if v.Kind() != reflect.Interface || v.IsNil() {
+		return
+	}
+
+	var name string
+	if name, ok = registeredName(v.Elem().Type()); ok {
+		node, err = encodeNode(name, v.Elem(), "")
+	}
+	return
+}
+
+// Encodes a slice or array of bytes, as base64 or as hexadecimal if the hex tag option is set.
+func encodeBytes(v reflect.Value, opts naming.TagOptions) string {
+	bytes := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(bytes), v)
+
+	if opts.Contains("hex") {
+		return hex.EncodeToString(bytes)
+	} else {
+		return base64.StdEncoding.EncodeToString(bytes)
+	}
+}
+
+// Converts a native non-compound Go value to its string representation.
+// Sizes and ratios are printed with their unit, as read by encodeScalarField.
+func encodeScalar(v reflect.Value, opts naming.TagOptions) (string, error) {
+	sizes := opts.Contains("bytesize") || v.Type() == byteSizeType
+	ratios := opts.Contains("ratio") || v.Type() == ratioType
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if sizes && v.Int() < 0 {
+			return "", fmt.Errorf("lsd: cannot marshal negative size %d", v.Int())
+		} else if sizes {
+			return formatByteSize(uint64(v.Int())), nil
+		}
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if sizes {
+			return formatByteSize(v.Uint()), nil
+		}
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32:
+		if ratios {
+			return formatRatio(v.Float(), 32), nil
+		}
+		return strconv.FormatFloat(v.Float(), 'g', -1, 32), nil
+	case reflect.Float64:
+		if ratios {
+			return formatRatio(v.Float(), 64), nil
+		}
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), nil
+	case reflect.Complex64:
+		return strings.Trim(strconv.FormatComplex(v.Complex(), 'g', -1, 64), "()"), nil
+	case reflect.Complex128:
+		return strings.Trim(strconv.FormatComplex(v.Complex(), 'g', -1, 128), "()"), nil
+	default:
+		return "", fmt.Errorf("lsd: cannot marshal value of kind %s", v.Kind())
+	}
+}
+
+// Encodes the fields of a structure as lists headed by the field names.
+func encodeStructFields(st reflect.Value) (values []selfValue, err error) {
+	for _, f := range typeFields(st.Type()) {
+		field, ok := encodedField(st, f.index)
+		if !ok {
+			continue
+		}
+
+		var node *selfNode
+		if node, err = encodeNode(f.name, field, f.opts); err != nil {
+			return nil, err
+		} else if node != nil {
+			values = append(values, node)
+		}
+	}
+
+	if rf, ok := remainField(st.Type()); ok {
+		var remain []selfValue
+		if remain, err = encodeRemain(st.FieldByIndex(rf.index)); err != nil {
+			return nil, err
+		}
+		values = append(values, remain...)
+	}
+	return
+}
+
+// Encodes the lists collected by a remain field, sorted by key for a stable output.
+// Lists kept in their LSD representation are parsed again.
+func encodeRemain(m reflect.Value) (values []selfValue, err error) {
+	if !isRemainType(m.Type()) {
+		return nil, fmt.Errorf("lsd: remain field must be of type map[string]lsd.Node, map[string]lsd.RawNode or map[string]string, not %s", m.Type())
+	}
+
+	keys := make([]string, 0, m.Len())
+	for _, k := range m.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		elem := m.MapIndex(reflect.ValueOf(key).Convert(m.Type().Key()))
+
+		var value selfValue
+		if elem.Type() == nodeType {
+			value = elem.Interface().(Node).value
+		} else if elem.Type() == rawNodeType {
+			value = elem.Interface().(RawNode).value
+		} else {
+			var root *selfNode
+			if root, err = newParser(elem.String(), defaultDecodeOptions).parseDocument(); err != nil {
+				return nil, err
+			} else if len(root.values) != 1 {
+				return nil, fmt.Errorf("lsd: remain entry `%s` must hold a single list", key)
+			}
+			value = root.values[0]
+		}
+
+		if node := encodeParsedValue(key, value); node != nil {
+			values = append(values, node)
+		}
+	}
+	return
+}
+
+// Encodes a parsed value as a list with the given head.
+// The values of a list are kept, and a string becomes the single value of the list.
+func encodeParsedValue(head string, value selfValue) *selfNode {
+	switch v := value.(type) {
+	case *selfNode:
+		node := *v
+		node.head = selfString{str: head}
+		return &node
+	case selfString:
+		return &selfNode{head: selfString{str: head}, values: []selfValue{v}}
+	}
+	return nil
+}
+
+// Gets the field of a structure designated by an index sequence.
+// Returns false if a pointer to an embedded structure is nil on the way.
+func encodedField(st reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && st.Kind() == reflect.Ptr {
+			if st.IsNil() {
+				return st, false
+			}
+			st = st.Elem()
+		}
+		st = st.Field(x)
+	}
+	return st, true
+}
+
+// Encodes a Go value as a list with the given head.
+// Returns a nil node for nil pointers and interfaces.
+func encodeNode(head string, v reflect.Value, opts naming.TagOptions) (node *selfNode, err error) {
+	if v.Type() == rawNodeType {
+		return encodeParsedValue(head, v.Interface().(RawNode).value), nil
+	} else if value, ok, err := marshalLSD(v); ok {
+		if err != nil {
+			return nil, err
+		}
+		return encodeParsedValue(head, value), nil
+	}
+
+	node = &selfNode{head: selfString{str: head}}
+	if variant, ok, err := encodeVariant(v); ok {
+		if err != nil || variant == nil {
+			return nil, err
+		}
+		node.values = []selfValue{variant}
+		return node, nil
+	}
+
+	if str, ok, err := marshalText(v); ok {
+		node.values = []selfValue{selfString{str: str}}
+		return node, err
+	}
+
+	v, ok := indirect(v)
+	if !ok {
+		return nil, nil
+	}
+	kind := v.Kind()
+
+	switch {
+	case isByteSequence(v.Type()):
+		if kind == reflect.Array || v.Len() > 0 {
+			node.values = []selfValue{selfString{str: encodeBytes(v, opts)}}
+		}
+
+	case isScalarKind(kind):
+		var str string
+		if str, err = encodeScalar(v, opts); err != nil {
+			return nil, err
+		}
+		node.values = []selfValue{selfString{str: str}}
+
+	case kind == reflect.Struct && isOrderedMap(v.Type()):
+		node.values, err = encodeOrderedMapEntries(v)
+
+	case kind == reflect.Struct:
+		node.values, err = encodeStructFields(v)
+
+	case kind == reflect.Slice || kind == reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			var elem selfValue
+			if elem, err = encodeElement(v.Index(i)); err != nil {
+				return nil, err
+			} else if elem != nil {
+				node.values = append(node.values, elem)
+			}
+		}
+
+	case kind == reflect.Map:
+		node.values, err = encodeMapEntries(v)
+
+	default:
+		err = fmt.Errorf("lsd: cannot marshal field `%s` of kind %s", head, kind)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Encodes an element of a slice or array.
+// Compound elements are lists headed by [] for slices and arrays, or by a
+// bullet point for structures and maps.
+func encodeElement(v reflect.Value) (selfValue, error) {
+	if v.Type() == rawNodeType {
+		return v.Interface().(RawNode).value, nil
+	} else if value, ok, err := marshalLSD(v); ok {
+		if _, isList := value.(*selfNode); isList && err == nil {
+			return encodeParsedValue("-", value), nil
+		}
+		return value, err
+	}
+
+	if variant, ok, err := encodeVariant(v); ok {
+		if err != nil || variant == nil {
+			return nil, err
+		}
+		return variant, nil
+	}
+
+	if str, ok, err := marshalText(v); ok {
+		return selfString{str: str}, err
+	}
+
+	v, ok := indirect(v)
+	if !ok {
+		return nil, nil
+	}
+
+	kind := v.Kind()
+	switch {
+	case isByteSequence(v.Type()):
+		return selfString{str: encodeBytes(v, "")}, nil
+
+	case isScalarKind(kind):
+		str, err := encodeScalar(v, "")
+		return selfString{str: str}, err
+
+	}
+
+	head := "-"
+	if kind == reflect.Slice || kind == reflect.Array {
+		head = ""
+	}
+
+	if node, err := encodeNode(head, v, ""); node != nil || err != nil {
+		return node, err
+	}
+	return nil, nil
+}
+
+// Converts a map key to the string heading its entry.
+func encodeKey(k reflect.Value) (string, error) {
+	if str, ok, err := marshalText(k); ok {
+		return str, err
+	}
+	return encodeScalar(k, "")
+}
+
+// Encodes the entries of a map as lists headed by the keys, sorted for a stable output.
+func encodeMapEntries(m reflect.Value) (values []selfValue, err error) {
+	keys := make([]string, 0, m.Len())
+	entries := make(map[string]reflect.Value, m.Len())
+
+	for _, k := range m.MapKeys() {
+		var key string
+		if key, err = encodeKey(k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		entries[key] = m.MapIndex(k)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		var node *selfNode
+		if node, err = encodeNode(key, entries[key], ""); err != nil {
+			return nil, err
+		} else if node != nil {
+			values = append(values, node)
+		}
+	}
+	return
+}
+
+// Encodes the entries of an OrderedMap as lists headed by the keys, in order.
+func encodeOrderedMapEntries(v reflect.Value) (values []selfValue, err error) {
+	if !v.CanAddr() {
+		addressable := reflect.New(v.Type()).Elem()
+		addressable.Set(v)
+		v = addressable
+	}
+
+	keys, entries := v.Addr().Interface().(orderedMap).entries()
+	for i, k := range keys {
+		var (
+			key  string
+			node *selfNode
+		)
+		if key, err = encodeKey(k); err != nil {
+			return nil, err
+		} else if node, err = encodeNode(key, entries[i], ""); err != nil {
+			return nil, err
+		} else if node != nil {
+			values = append(values, node)
+		}
+	}
+	return
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	conf := fuzzConfig{
+		Name:   "a b",
+		Tags:   []string{"x", ""},
+		Matrix: [][]int{{1, 2}, {3}},
+		Points: []fuzzPoint{{1, 2}},
+		Nested: fuzzNested{Name: "n", Ports: []uint16{80}},
+	}
+
+	out, err := Marshal(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"(Name \"a b\")\n",
+		"(Tags x [])\n",
+		"(Matrix\n    ([] 1 2)\n    ([] 3))\n",
+		"(Points\n    (-\n        (X 1)\n        (Y 2)))\n",
+		"(Nested\n    (Name n)\n    (Ports 80)\n    (Flags))\n",
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("%q not found in:\n%s", expected, out)
+		}
+	}
+
+	var decoded fuzzConfig
+	if err = LoadBytes(out, &decoded); err != nil {
+		t.Fatal(err)
+	} else if decoded.Name != conf.Name || len(decoded.Matrix) != 2 || decoded.Nested.Ports[0] != 80 {
+		t.Errorf("decoded %+v", decoded)
+	}
+}
+
+// Makes a matrix with the given number of rows.
+func benchmarkMatrix(rows int) [][]int {
+	matrix := make([][]int, rows)
+	for i := range matrix {
+		matrix[i] = []int{i, i * 2, i * 3}
+	}
+	return matrix
+}
+
+func BenchmarkMarshalMatrix(b *testing.B) {
+	for _, rows := range []int{1e3, 1e4, 1e5} {
+		conf := fuzzConfig{Matrix: benchmarkMatrix(rows)}
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Marshal(&conf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatRat(t *testing.T) {
+	for input, expected := range map[string]string{
+		"3/4":        "0.75",
+		"-5/4":       "-1.25",
+		"1/3":        "1/3",
+		"7/1":        "7",
+		"1/1024":     "0.0009765625",
+		"1/3125":     "0.00032",
+		"3/20":       "0.15",
+		"1/6":        "1/6",
+		"1e-30":      "0.000000000000000000000000000001",
+		"123.456000": "123.456",
+	} {
+		r, _ := new(big.Rat).SetString(input)
+		if str := formatRat(r); str != expected {
+			t.Errorf("%s: got %s, expected %s", input, str, expected)
+		}
+	}
+}
+
+type numbers struct {
+	Float  *big.Float
+	Rat    big.Rat
+	Rats   map[string]big.Rat
+	PtrRat *big.Rat
+}
+
+func TestBigNumbersRoundTrip(t *testing.T) {
+	const pi = "3.14159265358979323846264338327950288419716939937510582097494459"
+	var nums numbers
+	if err := LoadString("(Float "+pi+") (Rat 1.25) (Rats (a 0.1) (b 2/3)) (PtrRat -0.5)", &nums); err != nil {
+		t.Fatal(err)
+	}
+
+	if nums.Float.Prec() < 200 {
+		t.Errorf("got a precision of %d bits for %d digits", nums.Float.Prec(), len(pi)-1)
+	}
+	if nums.Float.Text('f', len(pi)-2) != pi {
+		t.Errorf("got %s, expected %s", nums.Float.Text('f', len(pi)-2), pi)
+	}
+
+	out, err := Marshal(&nums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"(Float " + pi + ")", "(Rat 1.25)", "(a 0.1)", "(b 2/3)", "(PtrRat -0.5)"} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("%q not found in:\n%s", expected, out)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdelugre/lsd/internal/naming"
+)
+
+// Policy used to match node heads with structure field names.
+type KeyMatching int
+
+const (
+	// Heads match field names, possibly with their first letter capitalized.
+	MatchCapitalized KeyMatching = iota
+	// Heads must match field names exactly.
+	MatchExact
+	// Heads match field names regardless of case.
+	MatchCaseInsensitive
+	// Heads written in snake_case or kebab-case match CamelCase field names,
+	// regardless of case.
+	MatchNormalized
+)
+
+// Describes the Go value a node is packed into.
+type fieldInfo struct {
+	name   string // Key of the field in documents.
+	index  []int
+	opts   naming.TagOptions
+	tagged bool         // Whether the name was set in the tag.
+	decode fieldDecoder // Packs values into the field, set for the fields of structure types.
+}
+
+// Packs a value into a structure field, following the field information.
+type fieldDecoder func(ps *packState, value selfValue, fi fieldInfo, field reflect.Value) error
+
+// Chooses once how the values of a structure field are packed, from its type
+// and tag options.
+// Scalars are converted and stored in place, with their options read once,
+// while other values are left to packIntoField.
+func newFieldDecoder(t reflect.Type, opts naming.TagOptions) fieldDecoder {
+	if t == rawNodeType || isUnmarshaler(t) || isTextUnmarshaler(t) || !isScalarKind(t.Kind()) {
+		return packField
+	}
+
+	sizes := opts.Contains("bytesize") || t == byteSizeType
+	ratios := opts.Contains("ratio") || t == ratioType
+	return func(ps *packState, value selfValue, fi fieldInfo, field reflect.Value) error {
+		var str selfString
+		switch v := value.(type) {
+		case selfString:
+			str = v
+		case *selfNode:
+			ps.trace(v, v.head.str, fi.name, t)
+			if len(v.values) != 1 {
+				return v.newPackError("bad number of values for scalar field `" + fi.name + "`")
+			} else if s, ok := v.values[0].(selfString); !ok {
+				return v.newPackError("expected a string element for scalar field `" + fi.name + "`")
+			} else {
+				str = s
+			}
+		default:
+			return value.packIntoField(ps, fi, field)
+		}
+
+		if ps.tracer != nil {
+			// Strings are only boxed into values when traced.
+			ps.trace(str, str.str, fi.name, t)
+		}
+		return str.setScalar(field, sizes, ratios)
+	}
+}
+
+// Packs a value into a field whatever its type.
+func packField(ps *packState, value selfValue, fi fieldInfo, field reflect.Value) error {
+	return value.packIntoField(ps, fi, field)
+}
+
+// Field metadata of a structure type, computed once per type.
+type structFields struct {
+	list   []fieldInfo // Fields which can be packed, in declaration order, with their decoders.
+	names  nameIndex   // Index of the fields in list, by name.
+	remain *fieldInfo  // Field tagged remain, if any.
+}
+
+// Field metadata of the structure types met so far, indexed by reflect.Type.
+// Shared by concurrent decoders and encoders.
+var fieldCache sync.Map
+
+// Gets the field metadata of a structure type, computing it on first use.
+func cachedFields(t reflect.Type) *structFields {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.(*structFields)
+	}
+
+	fields := &structFields{list: collectTypeFields(t)}
+	names := make([]string, len(fields.list))
+	for i, f := range fields.list {
+		names[i] = f.name
+	}
+	fields.names = newNameIndex(names)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if name, opts := naming.ParseTag(sf.Tag.Get("lsd")); sf.PkgPath == "" && opts.Contains("remain") {
+			fields.remain = &fieldInfo{name: name, index: sf.Index, opts: opts}
+			break
+		}
+	}
+
+	cached, _ := fieldCache.LoadOrStore(t, fields)
+	return cached.(*structFields)
+}
+
+// Gets the fields of a structure type which can be packed, in declaration order.
+// The returned slice is shared and must not be modified.
+func typeFields(t reflect.Type) []fieldInfo {
+	return cachedFields(t).list
+}
+
+// Computes the fields of a structure type which can be packed, in declaration order.
+// Fields of embedded structures and of structure fields tagged inline are
+// promoted, following the rules of encoding/json: a field hides the fields with
+// the same name nested deeper, and fields conflicting at the same depth are
+// dropped, unless a single one of them has its name set in the tag.
+func collectTypeFields(t reflect.Type) (fields []fieldInfo) {
+	all := collectFields(t, nil, map[reflect.Type]bool{t: true})
+
+	byName := make(map[string][]fieldInfo, len(all))
+	for _, f := range all {
+		byName[f.name] = append(byName[f.name], f)
+	}
+
+	for _, f := range all {
+		if dominant, ok := dominantField(byName[f.name]); ok && reflect.DeepEqual(dominant.index, f.index) {
+			fields = append(fields, f)
+		}
+	}
+	return
+}
+
+// Gathers the fields of a structure type, recursing into the promoted structures.
+// Index sequences are relative to the outermost structure.
+func collectFields(t reflect.Type, index []int, visited map[reflect.Type]bool) (fields []fieldInfo) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, opts := naming.ParseTag(sf.Tag.Get("lsd"))
+		if name == "-" {
+			continue
+		}
+
+		if opts.Contains("remain") {
+			continue
+		}
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr && ft.Name() == "" {
+			ft = ft.Elem()
+		}
+
+		fieldIndex := make([]int, len(index)+1)
+		copy(fieldIndex, index)
+		fieldIndex[len(index)] = i
+
+		promoted := ft.Kind() == reflect.Struct && !isTextUnmarshaler(ft) &&
+			(sf.Anonymous && name == "" || opts.Contains("inline"))
+
+		if promoted {
+			// Exported fields of an unexported embedded structure are still
+			// reachable, but a pointer to such a structure cannot be allocated.
+			if sf.PkgPath != "" && !(sf.Anonymous && sf.Type.Kind() == reflect.Struct) {
+				continue
+			}
+			if visited[ft] {
+				continue
+			}
+			visited[ft] = true
+			fields = append(fields, collectFields(ft, fieldIndex, visited)...)
+			delete(visited, ft)
+			continue
+		}
+
+		if sf.PkgPath != "" {
+			continue
+		}
+		tagged := name != ""
+		if !tagged {
+			name = sf.Name
+		}
+		fields = append(fields, fieldInfo{name: name, index: fieldIndex, opts: opts, tagged: tagged, decode: newFieldDecoder(sf.Type, opts)})
+	}
+	return
+}
+
+// Selects the field hiding the others among fields sharing the same name.
+// Returns false if none of them takes precedence.
+func dominantField(fields []fieldInfo) (fieldInfo, bool) {
+	depth := len(fields[0].index)
+	for _, f := range fields {
+		if len(f.index) < depth {
+			depth = len(f.index)
+		}
+	}
+
+	var candidates []fieldInfo
+	for _, f := range fields {
+		if len(f.index) == depth {
+			candidates = append(candidates, f)
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0], true
+	}
+
+	var tagged []fieldInfo
+	for _, f := range candidates {
+		if f.tagged {
+			tagged = append(tagged, f)
+		}
+	}
+	if len(tagged) == 1 {
+		return tagged[0], true
+	}
+	return fieldInfo{}, false
+}
+
+// Gets the field of a structure tagged remain, receiving the lists which do
+// not match any other field.
+func remainField(t reflect.Type) (fieldInfo, bool) {
+	if remain := cachedFields(t).remain; remain != nil {
+		return *remain, true
+	}
+	return fieldInfo{}, false
+}
+
+// Checks whether a type can hold the lists collected by a remain field,
+// either as nodes, as raw nodes, or as their LSD representation.
+func isRemainType(t reflect.Type) bool {
+	return t.Kind() == reflect.Map && t.Key().Kind() == reflect.String &&
+		(t.Elem() == nodeType || t.Elem() == rawNodeType || t.Elem().Kind() == reflect.String)
+}
+
+// Gets the field of a structure designated by an index sequence, allocating
+// the pointers to embedded structures found on the way.
+func fieldByIndex(st reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && st.Kind() == reflect.Ptr {
+			if st.IsNil() {
+				st.Set(reflect.New(st.Type().Elem()))
+			}
+			st = st.Elem()
+		}
+		st = st.Field(x)
+	}
+	return st
+}
+
+// Field names indexed to be matched with node heads.
+type nameIndex struct {
+	names      []string       // Names of the fields, in field order.
+	byName     map[string]int // Index of the fields, by name.
+	normalized []string       // Names without word separators, in field order.
+}
+
+// Indexes a list of field names.
+func newNameIndex(names []string) nameIndex {
+	index := nameIndex{names: names, byName: make(map[string]int, len(names)), normalized: make([]string, len(names))}
+	for i, name := range names {
+		index.byName[name] = i
+		index.normalized[i] = normalizeKey(name)
+	}
+	return index
+}
+
+// Looks up the fields matching a node head following the policy, returning
+// the indexes of the first two matches, or -1 in their absence.
+// A field whose name is exactly the head takes precedence.
+func (index *nameIndex) lookup(key string, policy KeyMatching) (first, second int) {
+	if i, ok := index.byName[key]; ok {
+		return i, -1
+	}
+
+	first, second = -1, -1
+	names := index.names
+	switch policy {
+	case MatchCapitalized:
+		// Field names being unique, only the capitalized head can match.
+		if i, ok := index.capitalized(key); ok {
+			first = i
+		}
+		return
+	case MatchNormalized:
+		key, names = normalizeKey(key), index.normalized
+	case MatchCaseInsensitive:
+	default:
+		return
+	}
+
+	for i, name := range names {
+		if !strings.EqualFold(key, name) {
+			continue
+		} else if first >= 0 {
+			return first, i
+		}
+		first = i
+	}
+	return
+}
+
+// Looks up the field named by a head with its first letter capitalized.
+// Short heads are capitalized in a buffer on the stack, which the compiler
+// does not copy to look it up.
+func (index *nameIndex) capitalized(key string) (i int, ok bool) {
+	var buf [64]byte
+	if key == "" {
+		return
+	} else if len(key)+utf8.UTFMax > len(buf) {
+		i, ok = index.byName[naming.PublicName(key)]
+		return
+	}
+
+	r, width := utf8.DecodeRuneInString(key)
+	n := utf8.EncodeRune(buf[:], unicode.ToUpper(r))
+	n += copy(buf[n:], key[width:])
+	i, ok = index.byName[string(buf[:n])]
+	return
+}
+
+// Word separators of snake_case and kebab-case names, built once.
+var keySeparators = strings.NewReplacer("_", "", "-", "")
+
+// Removes the word separators of snake_case and kebab-case names.
+func normalizeKey(key string) string {
+	return keySeparators.Replace(key)
+}
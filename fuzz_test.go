@@ -0,0 +1,239 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type fuzzPoint struct {
+	X, Y int16
+}
+
+type fuzzShape interface{}
+
+type fuzzCircle struct {
+	Center fuzzPoint
+	Radius float32
+}
+
+type fuzzNested struct {
+	Name  string
+	Ports []uint16
+	Flags map[string]bool
+}
+
+type fuzzConfig struct {
+	Name     string
+	Enabled  bool
+	Count    int8
+	Port     uint16
+	Mask     uint32 `lsd:",hex"`
+	Offset   int64
+	Scale    float64
+	Ratio    Ratio
+	Usage    float64 `lsd:",ratio"`
+	Size     ByteSize
+	Limit    uint64 `lsd:",bytesize"`
+	Signal   complex128
+	Big      *big.Int
+	Precise  *big.Float
+	Fraction big.Rat
+	Data     []byte
+	Rune     rune
+	Tags     []string
+	Matrix   [][]int
+	Triple   [3]uint8
+	Points   []fuzzPoint
+	Labels   map[string]string
+	Limits   map[uint8]fuzzPoint
+	Ordered  OrderedMap[string, int]
+	Nested   fuzzNested
+	Children []fuzzNested
+	Shape    fuzzShape
+	Any      interface{}
+	Raw      RawNode
+	Rest     map[string]RawNode `lsd:",remain"`
+}
+
+func init() {
+	RegisterName("circle", fuzzCircle{})
+	RegisterName("point", fuzzPoint{})
+}
+
+// Documents exercising every feature of the format, used as fuzzing seeds.
+var fuzzSeeds = []string{
+	"",
+	"(Name a)",
+	"(Port 7)",
+	"(Count -0x7f) (Port 0o17) (Mask 0xff) (Offset 1_000)",
+	"(Enabled yes) (Scale 1.5e3) (Ratio 50%) (Usage 1/4) (Size 4KiB) (Limit 1.5 MB)",
+	"(Signal 1+2i) (Big 123456789012345678901234567890) (Precise 3.14159265358979323846264338327950288) (Fraction 3/4)",
+	"(Data \"\\x00\\xff\") (Rune é)",
+	"(Tags a b [] \"c d\") (Matrix ([] 1 2) ([] 3)) (Triple 1 2 3)",
+	"(Points (- 1 2) (point 3 4) (- (X 5) (Y 6)))",
+	"(Labels (a b) (c [d e])) (Limits (1 (X 1) (Y 2)))",
+	"(Ordered (z 1) (a 2))",
+	"(Nested (Name n) (Ports 1 2) (Flags (a yes))) (Children (- (Name c)))",
+	"(Shape (circle (Center 1 2) (Radius 3)))",
+	"(Any (point 1 2)) (Raw (anything (goes here)))",
+	"(Unknown 1 2) (Other (x y))",
+	"#| block #| nested |# |# (Name #; skipped x) ; comment",
+	"(Name [=[a ]] b]=]) (Tags <<EOF\n  line\n  EOF\n)",
+	"\uFEFF(Name bom)\n---\n(Name next)",
+	"(Name \"\\U0010FFFF\\uD7FF\\t\")",
+	"(Nested (Name (nested list)))",
+	"(Matrix " + strings.Repeat("(", 20) + strings.Repeat(")", 20) + ")",
+}
+
+// Checks that decoding fails with regular errors only, and that documents
+// which can be decoded can be encoded and decoded back.
+func FuzzLoadString(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data string) {
+		if _, err := Parse(data); err != nil && strings.Contains(err.Error(), "internal error") {
+			t.Fatalf("Parse: %v", err)
+		}
+
+		var conf fuzzConfig
+		if err := LoadString(data, &conf); err != nil {
+			if strings.Contains(err.Error(), "internal error") {
+				t.Fatal(err)
+			}
+			return
+		}
+
+		out, err := Marshal(&conf)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+
+		var decoded fuzzConfig
+		if err = LoadBytes(out, &decoded); err != nil {
+			t.Fatalf("decoding the marshaled document %q: %v", out, err)
+		}
+		if again, err := Marshal(&decoded); err != nil {
+			t.Fatalf("Marshal: %v", err)
+		} else if string(again) != string(out) {
+			t.Fatalf("encoding is not stable:\n%s\n%s", out, again)
+		}
+	})
+}
+
+// Checks the decoding of streams with every decoder option, and that reading
+// the stream byte by byte gives the same documents and errors.
+func FuzzDecoder(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed, uint8(0))
+		f.Add(seed, uint8(0xff))
+	}
+
+	f.Fuzz(func(t *testing.T, data string, flags uint8) {
+		decode := func(r io.Reader) (results []string) {
+			dec := NewDecoder(r)
+			if flags&1 != 0 {
+				dec.ReplaceInvalidUTF8()
+			}
+			if flags&2 != 0 {
+				dec.AccumulateRepeatedFields()
+			}
+			if flags&4 != 0 {
+				dec.SetTracer(func(TraceEvent) {})
+			}
+			if flags&8 != 0 {
+				dec.SetMaxDepth(4)
+			}
+			if flags&16 != 0 {
+				dec.SetMaxStringLength(8)
+			}
+			dec.SetKeyMatching(KeyMatching(flags >> 5 % 4))
+
+			for i := 0; dec.More(); i++ {
+				if i > len(data) {
+					t.Fatal("decoder does not stop")
+				}
+				var conf fuzzConfig
+				if err := dec.Decode(&conf); err != nil {
+					if strings.Contains(err.Error(), "internal error") {
+						t.Fatal(err)
+					}
+					results = append(results, err.Error())
+				} else if out, err := Marshal(&conf); err != nil {
+					results = append(results, err.Error())
+				} else {
+					results = append(results, string(out))
+				}
+			}
+			return
+		}
+
+		whole := decode(strings.NewReader(data))
+		if bytes := decode(iotest.OneByteReader(strings.NewReader(data))); strings.Join(bytes, "\n---\n") != strings.Join(whole, "\n---\n") {
+			t.Fatalf("reading byte by byte gives:\n%s\ninstead of:\n%s", strings.Join(bytes, "\n---\n"), strings.Join(whole, "\n---\n"))
+		}
+	})
+}
+
+// Targets of the pack layer, with the tags they are decoded with.
+var fuzzFields = []struct {
+	tag string
+	new func() interface{}
+}{
+	{"", func() interface{} { return new(string) }},
+	{"", func() interface{} { return new(int) }},
+	{"hex", func() interface{} { return new(uint8) }},
+	{"", func() interface{} { return new(float32) }},
+	{"", func() interface{} { return new(complex64) }},
+	{"exact", func() interface{} { return new(big.Float) }},
+	{"", func() interface{} { return new(*big.Int) }},
+	{"bytesize", func() interface{} { return new(uint16) }},
+	{"ratio", func() interface{} { return new(float64) }},
+	{"", func() interface{} { return new([]byte) }},
+	{"", func() interface{} { return new([]int) }},
+	{"", func() interface{} { return new([2]string) }},
+	{"", func() interface{} { return new(map[int8]float64) }},
+	{"", func() interface{} { return new([]fuzzPoint) }},
+	{"", func() interface{} { return new(fuzzNested) }},
+	{"", func() interface{} { return new(fuzzShape) }},
+	{"", func() interface{} { return new(interface{}) }},
+	{"", func() interface{} { return new(RawNode) }},
+	{"", func() interface{} { return new(OrderedMap[string, []bool]) }},
+}
+
+// Decodes each value of a document into a field type chosen by the input.
+func FuzzDecodeField(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		for i := range fuzzFields {
+			f.Add(seed, uint8(i))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data string, kind uint8) {
+		doc, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		field := fuzzFields[int(kind)%len(fuzzFields)]
+		for _, value := range doc.Values() {
+			out := field.new()
+			if err := value.DecodeField(out, field.tag); err != nil && strings.Contains(err.Error(), "internal error") {
+				t.Fatal(err)
+			}
+			for _, v := range value.Values() {
+				if err := v.DecodeField(field.new(), field.tag); err != nil && strings.Contains(err.Error(), "internal error") {
+					t.Fatal(err)
+				}
+			}
+		}
+	})
+}
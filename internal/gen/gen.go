@@ -0,0 +1,9 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package gen generates Go code for the lsd command, from sample documents
+// or from structure declarations.
+// It is kept apart from the lsd package so that programs decoding documents do
+// not link the Go parser and formatter.
+package gen
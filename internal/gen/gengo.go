@@ -0,0 +1,379 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gdelugre/lsd"
+	"github.com/gdelugre/lsd/internal/naming"
+)
+
+// Kinds of values inferred from sample documents.
+type shapeKind int
+
+const (
+	shapeEmpty  shapeKind = iota // List without values.
+	shapeScalar                  // Single string.
+	shapeSlice                   // Several values, or elements headed by bullets or [].
+	shapeStruct                  // Lists headed by field names.
+	shapeMap                     // Lists headed by arbitrary keys.
+	shapeRaw                     // Values of incompatible kinds.
+)
+
+// Scalar types a string can be packed into, as a bit set.
+type scalarSet uint
+
+const (
+	scalarInt scalarSet = 1 << iota
+	scalarFloat
+	scalarBool
+	scalarSize
+	scalarRatio
+	scalarString
+)
+
+// Go types of the scalar sets, by order of preference.
+var scalarGoTypes = []struct {
+	set  scalarSet
+	name string
+}{
+	{scalarInt, "int"},
+	{scalarFloat, "float64"},
+	{scalarBool, "bool"},
+	{scalarSize, "lsd.ByteSize"},
+	{scalarRatio, "lsd.Ratio"},
+	{scalarString, "string"},
+}
+
+// Shape of the values of a list, inferred from sample documents.
+type goShape struct {
+	kind    shapeKind
+	scalars scalarSet  // Types every string of a scalar could be packed into.
+	elem    *goShape   // Shape of the elements of a slice, or of the values of a map.
+	fields  []*goField // Fields of a structure, in order of appearance.
+}
+
+// Field of a structure inferred from sample documents.
+type goField struct {
+	head     string
+	shape    *goShape
+	repeated bool // Whether the field is defined several times in a list.
+}
+
+// Heads which can be turned into Go field names.
+var identifierHead = regexp.MustCompile(`^[\pL_][\pL\pN_-]*$`)
+
+// Generates the Go declaration of the structures documents can be packed
+// into, inferring field types from sample documents.
+// The root structure is named typeName, and nested structures after their fields.
+func GenerateGo(pkg, typeName string, docs ...lsd.Node) ([]byte, error) {
+	if len(docs) == 0 {
+		return nil, errors.New("lsd: no sample document to generate types from")
+	}
+
+	var root *goShape
+	for _, doc := range docs {
+		if !doc.IsList() {
+			return nil, errors.New("lsd: sample document is not a list")
+		}
+		root = mergeShapes(root, inferStruct(doc.Values()))
+	}
+
+	gen := &goGenerator{names: make(map[string]bool)}
+	gen.declare(typeName, root)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by lsd gen-go from sample documents. Review before use.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	if gen.usesLSD {
+		fmt.Fprintf(&buf, "import \"github.com/gdelugre/lsd\"\n\n")
+	}
+	buf.WriteString(strings.Join(gen.decls, "\n"))
+
+	return format.Source(buf.Bytes())
+}
+
+// Gets the scalar types a string can be packed into.
+func inferScalar(str string) (set scalarSet) {
+	n := lsd.NewString(str)
+	set = scalarString
+	if _, err := n.DecodeInt(64); err == nil {
+		set |= scalarInt
+	}
+	if _, err := n.DecodeFloat(64); err == nil {
+		set |= scalarFloat
+	}
+	if _, err := n.DecodeBool(); err == nil {
+		set |= scalarBool
+	}
+	if _, err := n.DecodeSize(); err == nil {
+		set |= scalarSize
+	}
+	if _, err := n.DecodeRatio(); err == nil {
+		set |= scalarRatio
+	}
+	return
+}
+
+// Infers the shape of the values following the head of a list.
+func inferShape(values []lsd.Node) *goShape {
+	if len(values) == 0 {
+		return &goShape{kind: shapeEmpty}
+	}
+
+	strs, bullets, slices := 0, 0, 0
+	keyed := true
+	for _, v := range values {
+		if !v.IsList() {
+			strs++
+		} else if head := v.Head(); naming.IsBulletPoint(head) {
+			bullets++
+		} else if head == "" {
+			slices++
+		} else if !identifierHead.MatchString(head) {
+			keyed = false
+		}
+	}
+
+	switch {
+	case strs == len(values) && len(values) == 1:
+		return &goShape{kind: shapeScalar, scalars: inferScalar(values[0].Text())}
+
+	case strs == len(values):
+		var elem *goShape
+		for _, v := range values {
+			elem = mergeShapes(elem, &goShape{kind: shapeScalar, scalars: inferScalar(v.Text())})
+		}
+		return &goShape{kind: shapeSlice, elem: elem}
+
+	case bullets+slices == len(values):
+		// Elements of a slice of structures or of a slice of slices.
+		var elem *goShape
+		for _, v := range values {
+			elemShape := inferShape(v.Values())
+			if v.Head() == "" && elemShape.kind != shapeSlice {
+				elemShape = &goShape{kind: shapeSlice, elem: elemShape}
+			}
+			elem = mergeShapes(elem, elemShape)
+		}
+		return &goShape{kind: shapeSlice, elem: elem}
+
+	case strs == 0 && keyed:
+		return inferStruct(values)
+
+	case strs == 0:
+		var elem *goShape
+		for _, v := range values {
+			elem = mergeShapes(elem, inferShape(v.Values()))
+		}
+		return &goShape{kind: shapeMap, elem: elem}
+
+	default:
+		return &goShape{kind: shapeRaw}
+	}
+}
+
+// Infers the fields of a structure from lists headed by field names.
+// Fields defined several times are repeated fields, accumulating their values.
+func inferStruct(values []lsd.Node) *goShape {
+	shape := &goShape{kind: shapeStruct}
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if !v.IsList() {
+			continue
+		}
+
+		head := v.Head()
+		shape.addField(&goField{head: head, shape: inferShape(v.Values()), repeated: seen[head]})
+		seen[head] = true
+	}
+	return shape
+}
+
+// Adds a field to a structure shape, merging it with a field of the same head.
+func (shape *goShape) addField(field *goField) {
+	for _, f := range shape.fields {
+		if f.head == field.head {
+			f.shape = mergeShapes(f.shape, field.shape)
+			f.repeated = f.repeated || field.repeated
+			return
+		}
+	}
+	shape.fields = append(shape.fields, field)
+}
+
+// Merges the shapes inferred from two samples of the same values.
+func mergeShapes(a, b *goShape) *goShape {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.kind == shapeEmpty:
+		return b
+	case b.kind == shapeEmpty:
+		return a
+	case a.kind == shapeScalar && b.kind == shapeSlice:
+		return &goShape{kind: shapeSlice, elem: mergeShapes(a, b.elem)}
+	case a.kind == shapeSlice && b.kind == shapeScalar:
+		return &goShape{kind: shapeSlice, elem: mergeShapes(a.elem, b)}
+	case a.kind == shapeStruct && b.kind == shapeMap || a.kind == shapeMap && b.kind == shapeStruct:
+		return &goShape{kind: shapeMap, elem: mergeShapes(a.valuesShape(), b.valuesShape())}
+	case a.kind != b.kind:
+		return &goShape{kind: shapeRaw}
+	}
+
+	switch a.kind {
+	case shapeScalar:
+		return &goShape{kind: shapeScalar, scalars: a.scalars & b.scalars}
+	case shapeSlice, shapeMap:
+		return &goShape{kind: a.kind, elem: mergeShapes(a.elem, b.elem)}
+	case shapeStruct:
+		merged := &goShape{kind: shapeStruct}
+		for _, f := range a.fields {
+			merged.addField(&goField{head: f.head, shape: f.shape, repeated: f.repeated})
+		}
+		for _, f := range b.fields {
+			merged.addField(&goField{head: f.head, shape: f.shape, repeated: f.repeated})
+		}
+		return merged
+	default:
+		return a
+	}
+}
+
+// Gets the merged shape of the values of a map, or of the fields of a structure.
+func (shape *goShape) valuesShape() *goShape {
+	if shape.kind == shapeMap {
+		return shape.elem
+	}
+
+	var elem *goShape
+	for _, f := range shape.fields {
+		elem = mergeShapes(elem, f.shape)
+	}
+	return elem
+}
+
+// Converts a head to an exported Go identifier, in CamelCase.
+func goName(head string) string {
+	var name strings.Builder
+	upper := true
+	for _, r := range head {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		name.WriteRune(r)
+	}
+
+	if name.Len() == 0 {
+		return "Field"
+	} else if str := name.String(); unicode.IsDigit([]rune(str)[0]) {
+		return "F" + str
+	}
+	return name.String()
+}
+
+// Gets the name of the element type of a slice field, by removing a plural mark.
+func elemName(fieldName string) string {
+	if len(fieldName) > 1 && strings.HasSuffix(fieldName, "s") && !strings.HasSuffix(fieldName, "ss") {
+		return fieldName[:len(fieldName)-1]
+	}
+	return fieldName + "Item"
+}
+
+// Writes the Go declarations of the inferred structures.
+type goGenerator struct {
+	decls   []string // Declarations, the structures using others first.
+	names   map[string]bool
+	usesLSD bool
+}
+
+// Reserves a type name, numbering it if already used.
+func (gen *goGenerator) typeName(name string) string {
+	unique := name
+	for i := 2; gen.names[unique]; i++ {
+		unique = name + strconv.Itoa(i)
+	}
+	gen.names[unique] = true
+	return unique
+}
+
+// Declares a structure type and the nested structures it uses.
+func (gen *goGenerator) declare(name string, shape *goShape) string {
+	name = gen.typeName(name)
+	index := len(gen.decls)
+	gen.decls = append(gen.decls, "")
+
+	var body bytes.Buffer
+	fieldNames := make(map[string]bool)
+	for _, f := range shape.fields {
+		fieldName := goName(f.head)
+		for i := 2; fieldNames[fieldName]; i++ {
+			fieldName = goName(f.head) + strconv.Itoa(i)
+		}
+		fieldNames[fieldName] = true
+
+		fieldShape := f.shape
+		if f.repeated && fieldShape.kind != shapeSlice {
+			fieldShape = &goShape{kind: shapeSlice, elem: fieldShape}
+		}
+
+		fmt.Fprintf(&body, "\t%s %s", fieldName, gen.goType(fieldName, fieldShape))
+		if fieldName != f.head && fieldName != naming.PublicName(f.head) {
+			fmt.Fprintf(&body, " `lsd:%q`", f.head)
+		}
+		if f.repeated {
+			fmt.Fprintf(&body, " // Repeated, decode with Decoder.AccumulateRepeatedFields.")
+		}
+		fmt.Fprintf(&body, "\n")
+	}
+
+	gen.decls[index] = fmt.Sprintf("type %s struct {\n%s}\n", name, body.String())
+	return name
+}
+
+// Gets the Go type of a shape, declaring the structures it needs.
+func (gen *goGenerator) goType(name string, shape *goShape) string {
+	switch shape.kind {
+	case shapeScalar:
+		for _, t := range scalarGoTypes {
+			if shape.scalars&t.set != 0 {
+				gen.usesLSD = gen.usesLSD || strings.HasPrefix(t.name, "lsd.")
+				return t.name
+			}
+		}
+		return "string"
+
+	case shapeSlice:
+		return "[]" + gen.goType(elemName(name), shape.elem)
+
+	case shapeStruct:
+		return gen.declare(name, shape)
+
+	case shapeMap:
+		return "map[string]" + gen.goType(name+"Entry", shape.elem)
+
+	case shapeRaw:
+		gen.usesLSD = true
+		return "lsd.RawNode"
+
+	default:
+		return "[]string"
+	}
+}
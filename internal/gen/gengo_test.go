@@ -0,0 +1,53 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gdelugre/lsd"
+)
+
+func TestGenerateGo(t *testing.T) {
+	var docs []lsd.Node
+	for _, sample := range []string{
+		"(Name a) (Port 80) (Limit 4KiB) (Users (- (Name a) (Admin yes))) (Depends x) (Depends y)",
+		"(Name b) (Port 8080) (Ratio 50%) (Env (PATH /bin)) (Users (- (Name b)))",
+	} {
+		doc, err := lsd.Parse(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	code, err := GenerateGo("config", "Config", docs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"package config\n",
+		"import \"github.com/gdelugre/lsd\"\n",
+		"\tName    string\n",
+		"\tPort    int\n",
+		"\tLimit   lsd.ByteSize\n",
+		"\tUsers   []User\n",
+		"\tDepends []string // Repeated",
+		"\tRatio   lsd.Ratio\n",
+		"\tEnv     Env\n",
+		"type User struct {\n\tName  string\n\tAdmin bool\n}",
+		"type Env struct {\n\tPATH string\n}",
+	} {
+		if !strings.Contains(string(code), expected) {
+			t.Errorf("%q not found in:\n%s", expected, code)
+		}
+	}
+
+	if _, err := GenerateGo("config", "Config"); err == nil {
+		t.Error("no sample accepted")
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdelugre/lsd/internal/naming"
+)
+
+// Basic Go types decoded natively by the generated methods, with their size in bits.
+var basicBitSizes = map[string]int{
+	"string": 0, "bool": 0,
+	"int": 0, "int8": 8, "int16": 16, "int32": 32, "int64": 64, "rune": 32,
+	"uint": 0, "uint8": 8, "uint16": 16, "uint32": 32, "uint64": 64, "byte": 8,
+	"float32": 32, "float64": 64,
+	"lsd.ByteSize": 64, "lsd.Ratio": 64,
+}
+
+// Ways a field is decoded by the generated methods.
+type methodKind int
+
+const (
+	methodFallback methodKind = iota // Through reflection, with DecodeField and MarshalField.
+	methodScalar                     // With the scalar decoding methods of Node.
+	methodStruct                     // With the generated methods of the field type.
+	methodSlice                      // Element by element, the elements being scalars or structures.
+)
+
+// Field of a structure handled by the generated methods.
+type methodField struct {
+	goName  string // Name of the field in Go.
+	name    string // Key of the field in documents.
+	tag     string
+	typ     string // Go type of the field, as written in the source.
+	kind    methodKind
+	elem    *methodField // Element of a slice.
+	basic   string       // Basic type of a scalar.
+	slice   bool         // Whether the field is a slice, accumulating repeated definitions.
+	convert bool         // Whether the scalar type is a named type converted from its basic type.
+}
+
+// Generates UnmarshalLSD and MarshalLSD methods for structure types declared
+// in the Go package found in dir, decoding and encoding them without reflection.
+// Fields of other types than scalars, slices and the generated structures,
+// or with tag options, fall back to reflection.
+func GenerateMethods(dir string, typeNames ...string) ([]byte, error) {
+	if len(typeNames) == 0 {
+		return nil, errors.New("lsd: no type to generate methods for")
+	}
+
+	fset := token.NewFileSet()
+	notTest := func(fi os.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }
+	pkgs, err := parser.ParseDir(fset, dir, notTest, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		gen := newMethodGenerator(pkgs[name])
+		if _, ok := gen.structs[typeNames[0]]; ok {
+			return gen.generate(name, typeNames)
+		}
+	}
+	return nil, fmt.Errorf("lsd: type %s not found in %s", typeNames[0], dir)
+}
+
+// Writes the methods of the structure types of a package.
+type methodGenerator struct {
+	structs     map[string]*ast.StructType // Structure types declared in the package.
+	basics      map[string]string          // Named types of the package, by their basic type.
+	textMethods map[string]bool            // Types implementing MarshalText or UnmarshalText.
+	generated   map[string]bool            // Types receiving generated methods.
+	usesStrconv bool
+}
+
+// Indexes the type declarations and methods of a package.
+func newMethodGenerator(pkg *ast.Package) *methodGenerator {
+	gen := &methodGenerator{
+		structs:     make(map[string]*ast.StructType),
+		basics:      make(map[string]string),
+		textMethods: make(map[string]bool),
+		generated:   make(map[string]bool),
+	}
+
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					ts, ok := spec.(*ast.TypeSpec)
+					if !ok || ts.Assign.IsValid() {
+						continue
+					}
+					switch t := ts.Type.(type) {
+					case *ast.StructType:
+						gen.structs[ts.Name.Name] = t
+					case *ast.Ident, *ast.SelectorExpr:
+						gen.basics[ts.Name.Name] = exprString(t)
+					}
+				}
+
+			case *ast.FuncDecl:
+				if decl.Recv != nil && (decl.Name.Name == "MarshalText" || decl.Name.Name == "UnmarshalText") {
+					recv := decl.Recv.List[0].Type
+					if star, ok := recv.(*ast.StarExpr); ok {
+						recv = star.X
+					}
+					gen.textMethods[exprString(recv)] = true
+				}
+			}
+		}
+	}
+	return gen
+}
+
+// Prints a type expression as written in the source.
+func exprString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+// Gets the basic type a type expression is declared with, if any.
+// Types declared from ByteSize or Ratio are plain numbers to reflection,
+// and are left to it.
+func (gen *methodGenerator) basicType(typ string) (string, bool) {
+	named := typ
+	for i := 0; i <= len(gen.basics) && !gen.textMethods[named]; i++ {
+		if _, ok := basicBitSizes[named]; ok && (named == typ || !strings.HasPrefix(named, "lsd.")) {
+			return named, true
+		} else if next, ok := gen.basics[named]; ok {
+			named = next
+		} else {
+			break
+		}
+	}
+	return "", false
+}
+
+// Describes how the generated methods handle a type expression.
+func (gen *methodGenerator) describe(expr ast.Expr) *methodField {
+	f := &methodField{typ: exprString(expr), kind: methodFallback}
+	if basic, ok := gen.basicType(f.typ); ok {
+		f.kind, f.basic, f.convert = methodScalar, basic, basic != f.typ
+	} else if gen.generated[f.typ] {
+		f.kind = methodStruct
+	} else if array, ok := expr.(*ast.ArrayType); ok && array.Len == nil {
+		// Byte slices are decoded from a single string, like scalars.
+		elem := gen.describe(array.Elt)
+		f.slice = elem.basic != "byte" && elem.basic != "uint8"
+		if f.slice && (elem.kind == methodScalar || elem.kind == methodStruct) {
+			f.kind, f.elem = methodSlice, elem
+		}
+	}
+	return f
+}
+
+// Gets the fields of a structure type handled by the generated methods.
+func (gen *methodGenerator) fields(typeName string) ([]*methodField, error) {
+	var fields []*methodField
+	names := make(map[string]bool)
+
+	for _, field := range gen.structs[typeName].Fields.List {
+		var tag string
+		if field.Tag != nil {
+			unquoted, _ := strconv.Unquote(field.Tag.Value)
+			tag = reflect.StructTag(unquoted).Get("lsd")
+		}
+		name, opts := naming.ParseTag(tag)
+
+		if len(field.Names) == 0 {
+			return nil, fmt.Errorf("lsd: cannot generate methods for %s: embedded field %s", typeName, exprString(field.Type))
+		} else if opts.Contains("inline") || opts.Contains("remain") {
+			return nil, fmt.Errorf("lsd: cannot generate methods for %s: field %s is tagged %s", typeName, field.Names[0].Name, opts)
+		} else if name == "-" {
+			continue
+		}
+
+		for _, ident := range field.Names {
+			if !ident.IsExported() {
+				continue
+			}
+
+			f := gen.describe(field.Type)
+			f.goName, f.name, f.tag = ident.Name, name, tag
+			if name == "" {
+				f.name = ident.Name
+			}
+			if opts != "" && f.kind != methodFallback {
+				// Tag options are only honoured by reflection.
+				f.kind, f.elem = methodFallback, nil
+			}
+
+			if names[f.name] {
+				return nil, fmt.Errorf("lsd: cannot generate methods for %s: several fields named %s", typeName, f.name)
+			}
+			names[f.name] = true
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// Generates the methods of the given structure types.
+func (gen *methodGenerator) generate(pkg string, typeNames []string) ([]byte, error) {
+	for _, name := range typeNames {
+		if _, ok := gen.structs[name]; !ok {
+			return nil, fmt.Errorf("lsd: structure type %s not found", name)
+		}
+		gen.generated[name] = true
+	}
+
+	var body bytes.Buffer
+	for _, name := range typeNames {
+		fields, err := gen.fields(name)
+		if err != nil {
+			return nil, err
+		}
+		gen.writeFields(&body, name, fields)
+		gen.writeUnmarshal(&body, name, fields)
+		gen.writeMarshal(&body, name, fields)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by lsd gen-methods. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	if gen.usesStrconv {
+		fmt.Fprintf(&buf, "import (\n\t\"strconv\"\n\n\t\"github.com/gdelugre/lsd\"\n)\n\n")
+	} else {
+		fmt.Fprintf(&buf, "import \"github.com/gdelugre/lsd\"\n\n")
+	}
+	buf.Write(body.Bytes())
+
+	return format.Source(buf.Bytes())
+}
+
+// Gets the name of the variable describing the fields of a type.
+func fieldsVarName(typeName string) string {
+	r, size := utf8.DecodeRuneInString(typeName)
+	return string(unicode.ToLower(r)) + typeName[size:] + "LSDFields"
+}
+
+// Writes the variable describing the fields of a type.
+func (gen *methodGenerator) writeFields(w *bytes.Buffer, typeName string, fields []*methodField) {
+	var names, repeatable []string
+	for _, f := range fields {
+		names = append(names, strconv.Quote(f.name))
+		repeatable = append(repeatable, strconv.FormatBool(f.slice))
+	}
+
+	fmt.Fprintf(w, "// Fields of %s, in declaration order.\n", typeName)
+	fmt.Fprintf(w, "var %s = &lsd.Fields{\n", fieldsVarName(typeName))
+	fmt.Fprintf(w, "Type: %q,\n", typeName)
+	fmt.Fprintf(w, "Names: []string{%s},\n", strings.Join(names, ", "))
+	fmt.Fprintf(w, "Repeatable: []bool{%s},\n", strings.Join(repeatable, ", "))
+	fmt.Fprintf(w, "}\n\n")
+}
+
+// Writes the UnmarshalLSD method of a type.
+func (gen *methodGenerator) writeUnmarshal(w *bytes.Buffer, typeName string, fields []*methodField) {
+	fmt.Fprintf(w, "// Decodes a %s from a node without reflection.\n", typeName)
+	fmt.Fprintf(w, "func (v *%s) UnmarshalLSD(n lsd.Node) error {\n", typeName)
+	fmt.Fprintf(w, "return n.DecodeFields(%s, func(index int, f lsd.Node, repeated bool) error {\n", fieldsVarName(typeName))
+	fmt.Fprintf(w, "switch index {\n")
+
+	for i, f := range fields {
+		target := "v." + f.goName
+		fmt.Fprintf(w, "case %d:\n", i)
+
+		switch f.kind {
+		case methodScalar:
+			gen.writeDecodeScalar(w, "f", target, f)
+
+		case methodStruct:
+			fmt.Fprintf(w, "return %s.UnmarshalLSD(f)\n", target)
+
+		case methodSlice:
+			fmt.Fprintf(w, "count, err := f.SliceLen()\nif err != nil {\nreturn err\n}\n")
+			fmt.Fprintf(w, "xs := make(%s, count)\n", f.typ)
+			fmt.Fprintf(w, "for i := range xs {\n")
+			elemType := ""
+			if f.elem.kind == methodStruct {
+				elemType = f.elem.typ
+			}
+			fmt.Fprintf(w, "e := f.Index(i)\nif err := e.CheckElement(%q); err != nil {\nreturn err\n}\n", elemType)
+			if f.elem.kind == methodStruct {
+				fmt.Fprintf(w, "if err := xs[i].UnmarshalLSD(e); err != nil {\nreturn err\n}\n")
+			} else {
+				gen.writeDecodeScalar(w, "e", "xs[i]", f.elem)
+			}
+			fmt.Fprintf(w, "}\n")
+			fmt.Fprintf(w, "if repeated {\n%s = append(%s, xs...)\n} else {\n%s = xs\n}\n", target, target, target)
+
+		default:
+			if f.slice {
+				fmt.Fprintf(w, "if repeated {\nvar xs %s\nif err := f.DecodeField(&xs, %q); err != nil {\nreturn err\n}\n", f.typ, f.tag)
+				fmt.Fprintf(w, "%s = append(%s, xs...)\nreturn nil\n}\n", target, target)
+			}
+			fmt.Fprintf(w, "return f.DecodeField(&%s, %q)\n", target, f.tag)
+		}
+	}
+
+	fmt.Fprintf(w, "}\nreturn nil\n})\n}\n\n")
+}
+
+// Writes the decoding of a scalar node into a target.
+func (gen *methodGenerator) writeDecodeScalar(w *bytes.Buffer, node, target string, f *methodField) {
+	bitSize := basicBitSizes[f.basic]
+	switch {
+	case f.basic == "string":
+		fmt.Fprintf(w, "x, err := %s.DecodeString()\n", node)
+	case f.basic == "bool":
+		fmt.Fprintf(w, "x, err := %s.DecodeBool()\n", node)
+	case f.basic == "lsd.ByteSize":
+		fmt.Fprintf(w, "x, err := %s.DecodeSize()\n", node)
+	case f.basic == "lsd.Ratio":
+		fmt.Fprintf(w, "x, err := %s.DecodeRatio()\n", node)
+	case strings.HasPrefix(f.basic, "float"):
+		fmt.Fprintf(w, "x, err := %s.DecodeFloat(%d)\n", node, bitSize)
+	case strings.HasPrefix(f.basic, "uint") || f.basic == "byte":
+		fmt.Fprintf(w, "x, err := %s.DecodeUint(%d)\n", node, bitSize)
+	default:
+		fmt.Fprintf(w, "x, err := %s.DecodeInt(%d)\n", node, bitSize)
+	}
+	fmt.Fprintf(w, "if err != nil {\nreturn err\n}\n")
+
+	if f.basic == "string" || f.basic == "bool" || f.basic == "lsd.ByteSize" || f.basic == "lsd.Ratio" || f.basic == "int64" || f.basic == "uint64" || f.basic == "float64" {
+		if !f.convert {
+			fmt.Fprintf(w, "%s = x\n", target)
+			return
+		}
+	}
+	fmt.Fprintf(w, "%s = %s(x)\n", target, f.typ)
+}
+
+// Writes the MarshalLSD method of a type.
+func (gen *methodGenerator) writeMarshal(w *bytes.Buffer, typeName string, fields []*methodField) {
+	fmt.Fprintf(w, "// Encodes a %s as a node without reflection.\n", typeName)
+	fmt.Fprintf(w, "func (v *%s) MarshalLSD() (lsd.Node, error) {\n", typeName)
+	fmt.Fprintf(w, "values := make([]lsd.Node, 0, %d)\n", len(fields))
+
+	for _, f := range fields {
+		source := "v." + f.goName
+		switch f.kind {
+		case methodScalar:
+			fmt.Fprintf(w, "values = append(values, lsd.NewList(%q, %s))\n", f.name, gen.encodeScalar(source, f))
+
+		case methodStruct:
+			fmt.Fprintf(w, "{\nx, err := %s.MarshalLSD()\nif err != nil {\nreturn lsd.Node{}, err\n}\n", source)
+			fmt.Fprintf(w, "values = append(values, x.WithHead(%q))\n}\n", f.name)
+
+		case methodSlice:
+			fmt.Fprintf(w, "{\nxs := make([]lsd.Node, len(%s))\n", source)
+			fmt.Fprintf(w, "for i := range %s {\n", source)
+			if f.elem.kind == methodStruct {
+				fmt.Fprintf(w, "x, err := %s[i].MarshalLSD()\nif err != nil {\nreturn lsd.Node{}, err\n}\nxs[i] = x.WithHead(\"-\")\n", source)
+			} else {
+				fmt.Fprintf(w, "xs[i] = %s\n", gen.encodeScalar(source+"[i]", f.elem))
+			}
+			fmt.Fprintf(w, "}\nvalues = append(values, lsd.NewList(%q, xs...))\n}\n", f.name)
+
+		default:
+			fmt.Fprintf(w, "if x, err := lsd.MarshalField(%q, &%s, %q); err != nil {\nreturn lsd.Node{}, err\n", f.name, source, f.tag)
+			fmt.Fprintf(w, "} else if x.IsList() {\nvalues = append(values, x)\n}\n")
+		}
+	}
+
+	fmt.Fprintf(w, "return lsd.NewList(%q, values...), nil\n}\n\n", typeName)
+}
+
+// Gets the expression encoding a scalar as a string node.
+func (gen *methodGenerator) encodeScalar(source string, f *methodField) string {
+	bitSize := basicBitSizes[f.basic]
+	var str string
+	switch {
+	case f.basic == "string":
+		str = source
+		if f.convert {
+			str = "string(" + source + ")"
+		}
+	case f.basic == "lsd.ByteSize" || f.basic == "lsd.Ratio":
+		str = source + ".String()"
+	case f.basic == "bool" && !f.convert:
+		str = "strconv.FormatBool(" + source + ")"
+	case f.basic == "bool":
+		str = "strconv.FormatBool(bool(" + source + "))"
+	case strings.HasPrefix(f.basic, "float"):
+		str = fmt.Sprintf("strconv.FormatFloat(float64(%s), 'g', -1, %d)", source, bitSize)
+	case strings.HasPrefix(f.basic, "uint") || f.basic == "byte":
+		str = "strconv.FormatUint(uint64(" + source + "), 10)"
+	default:
+		str = "strconv.FormatInt(int64(" + source + "), 10)"
+	}
+
+	if strings.HasPrefix(str, "strconv.") {
+		gen.usesStrconv = true
+	}
+	return "lsd.NewString(" + str + ")"
+}
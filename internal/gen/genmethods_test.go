@@ -0,0 +1,75 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const methodsSample = `package conf
+
+import "github.com/gdelugre/lsd"
+
+type Config struct {
+	Name   string
+	Port   uint16 ` + "`lsd:\"port\"`" + `
+	Cache  lsd.ByteSize
+	Users  []User
+	Limits map[string]int
+	Skip   int ` + "`lsd:\"-\"`" + `
+}
+
+type Open struct {
+	Extra map[string]lsd.RawNode ` + "`lsd:\",remain\"`" + `
+}
+
+type User struct {
+	Login  string
+	Groups []string
+}
+`
+
+func TestGenerateMethods(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsd-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "conf.go"), []byte(methodsSample), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := GenerateMethods(dir, "Config", "User")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"package conf\n",
+		"func (v *Config) UnmarshalLSD(n lsd.Node) error {",
+		"func (v *Config) MarshalLSD() (lsd.Node, error) {",
+		"func (v *User) UnmarshalLSD(n lsd.Node) error {",
+		`"port"`,
+		"lsd.MarshalField(\"Limits\"",
+	} {
+		if !strings.Contains(string(code), expected) {
+			t.Errorf("%q not found in:\n%s", expected, code)
+		}
+	}
+	if strings.Contains(string(code), `"Skip"`) {
+		t.Errorf("ignored field generated:\n%s", code)
+	}
+
+	for _, typeName := range []string{"Missing", "Open"} {
+		if _, err := GenerateMethods(dir, typeName); err == nil {
+			t.Errorf("%s accepted", typeName)
+		}
+	}
+}
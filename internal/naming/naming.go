@@ -0,0 +1,55 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package naming holds the rules matching list heads with Go fields, shared by
+// the lsd package and the code generator so that both follow the same syntax.
+package naming
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Options following the name in the `lsd` tag of a structure field.
+type TagOptions string
+
+// Capitalizes the name of a structure field, giving the name a head is matched
+// with by default.
+func PublicName(fieldName string) string {
+	if len(fieldName) == 0 {
+		return fieldName
+	}
+	r, width := utf8.DecodeRuneInString(fieldName)
+	return string(unicode.ToUpper(r)) + fieldName[width:]
+}
+
+// Checks whether a head is a bullet point, introducing an element of a slice.
+func IsBulletPoint(str string) bool {
+	r, _ := utf8.DecodeRuneInString(str)
+	return r == '-' || r == '*' || r == '•' || r == '◦' || r == '‣' || r == '⁃'
+}
+
+// Splits a `lsd` tag into the field name and its options.
+func ParseTag(tag string) (string, TagOptions) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], TagOptions(tag[i+1:])
+	}
+	return tag, ""
+}
+
+// Checks whether an option is present in a tag.
+func (opts TagOptions) Contains(option string) bool {
+	for s := string(opts); s != ""; {
+		var next string
+		if i := strings.Index(s, ","); i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == option {
+			return true
+		}
+		s = next
+	}
+	return false
+}
@@ -6,24 +6,171 @@ package lsd
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"reflect"
+	"strings"
+	"unsafe"
 )
 
+// Error returned when a document of a stream cannot be decoded.
+type documentError struct {
+	index uint
+	err   error
+}
+
+// Error printing.
+func (err *documentError) Error() string {
+	return fmt.Sprintf("document %d: %s", err.index, err.err)
+}
+
+// Gets the underlying parsing or packing error.
+func (err *documentError) Unwrap() error {
+	return err.err
+}
+
+// Decoder reads and decodes a stream of LSD documents.
+// Documents are separated by a `---` string at the top level.
+// The stream is read incrementally: a document is decoded as soon as the
+// separator following it has been read, so a Decoder can follow a stream
+// which is still being written to. The last document ends with the stream.
+type Decoder struct {
+	r       io.Reader
+	opts    decodeOptions
+	maxSize int64
+	index   uint
+	err     error    // Syntax or stream error, ending the stream.
+	pending string   // Data read from the stream and not decoded yet.
+	at      Position // Position of the pending data in the stream.
+	read    int64    // Number of bytes read from the stream.
+	eof     bool     // Whether the stream has been read up to its end.
+}
+
+// Minimum number of bytes read from the stream at once by a Decoder.
+const minReadSize = 4096
+
+// Checks the output value is a pointer to a struct and returns the struct.
+func structOutput(out interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, errors.New("lsd: decoding expects a non-nil pointer to a struct")
+	}
+
+	return v.Elem(), nil
+}
+
+// Creates a new parser for a self-ml input.
+// A leading byte order mark is skipped.
+func newParser(data string, opts decodeOptions) *selfParser {
+	p := &selfParser{decodeOptions: opts, input: data, r: '\n'}
+	if strings.HasPrefix(data, byteOrderMark) {
+		p.pos = len(byteOrderMark)
+	}
+	return p
+}
+
+// Parses the next document from the parser input into a root node.
+// Parsing stops at the end of data or at the next document separator.
+func (p *selfParser) parseDocument() (*selfNode, error) {
+	rootNode := &selfNode{root: true, head: selfString{str: "root"}}
+
+	var err error
+	rootNode.values, err = p.parseNodeBody(true)
+	if p.err != nil {
+		return nil, p.err
+	} else if err != nil {
+		// The position of the next document is unknown after a syntax error.
+		p.fail(err)
+		return nil, err
+	}
+	return rootNode, nil
+}
+
+// Reports an internal error raised while decoding as a regular error, which
+// ends the stream as the parser state is unknown.
+// Any other panic, like one raised by an UnmarshalLSD or UnmarshalText method
+// or by a bug, is propagated.
+// Must be deferred by the functions of the package API.
+func (p *selfParser) recoverError(err *error) {
+	if r := recover(); r != nil {
+		ie, ok := r.(internalError)
+		if !ok {
+			panic(r)
+		}
+		*err = p.newError("internal error: " + ie.message)
+		p.fail(*err)
+	}
+}
+
+// Parses the next document from the parser input and fills the output structure.
+// Parsing stops at the end of data or at the next document separator.
+// Internal errors are reported as regular errors.
+func (p *selfParser) decodeDocument(out interface{}) (err error) {
+	st, err := structOutput(out)
+	if err != nil {
+		return
+	}
+
+	defer p.recoverError(&err)
+
+	rootNode, err := p.parseDocument()
+	if err != nil {
+		return
+	}
+	return p.packDocument(rootNode, st)
+}
+
+// Fills the output structure with a parsed document.
+func (p *selfParser) packDocument(rootNode *selfNode, st reflect.Value) error {
+	ps := &packState{decodeOptions: p.decodeOptions}
+	if isUnmarshaler(st.Type()) {
+		return unmarshalLSD(ps, rootNode, st)
+	}
+	return rootNode.packToStructByFieldName(ps, st)
+}
+
+// Checks that nothing but document separators follows the document which was just read.
+func (p *selfParser) checkSingleDocument() error {
+	if p.skipDocumentSeparators(); p.err != nil {
+		return p.err
+	} else if !p.eod {
+		return p.newError("multiple documents in input, use a Decoder to read them")
+	}
+	return nil
+}
+
 // Parses a self-ml string and fills the output structure.
 func LoadString(data string, out interface{}) (err error) {
-	p := selfParser{input: data, r: '\n'}
-	rootNode := selfNode{root: true, head: selfString{str: "root"}}
-	if rootNode.values, err = p.parseNodeBody(true); err != nil {
+	p := newParser(data, defaultDecodeOptions)
+	if err = p.decodeDocument(out); err != nil {
 		return
 	}
+	return p.checkSingleDocument()
+}
 
-	v := reflect.ValueOf(out)
-	if v.Kind() != reflect.Ptr && v.Elem().Kind() != reflect.Struct {
-		return errors.New("loadFile/loadString expects a pointer to a struct")
+// Parses a self-ml string without packing it.
+// Returns a list node whose values are the top-level lists of the document.
+func Parse(data string) (_ Node, err error) {
+	p := newParser(data, defaultDecodeOptions)
+	defer p.recoverError(&err)
+
+	rootNode, err := p.parseDocument()
+	if err != nil {
+		return Node{}, err
+	} else if err = p.checkSingleDocument(); err != nil {
+		return Node{}, err
 	}
+	return Node{rootNode, p.decodeOptions}, nil
+}
 
-	return rootNode.packToStructByFieldName(v.Elem())
+// Parses a self-ml document held in a byte slice and fills the output structure.
+// The whole of data is copied before parsing, costing one allocation of its size.
+// Decoded strings are slices of the parsed input, and the copy keeps them from
+// changing when the caller modifies or reuses data afterwards.
+// Load and Decoder parse buffers they allocate and own, without this copy.
+func LoadBytes(data []byte, out interface{}) error {
+	return LoadString(string(data), out)
 }
 
 // Parses a self-ml file on disk and fills the output structure.
@@ -33,5 +180,211 @@ func Load(path string, out interface{}) (err error) {
 		return
 	}
 
-	return LoadString(string(bytes), out)
+	return LoadString(ownedString(bytes), out)
+}
+
+// Converts a byte slice to a string without copying it.
+// The slice must not be modified afterwards, which holds for buffers read by
+// the package itself. Strings decoded from the input are then sliced from it.
+func ownedString(bytes []byte) string {
+	return *(*string)(unsafe.Pointer(&bytes))
+}
+
+// Returns a new decoder reading documents from r.
+// Data is read from r as documents are decoded.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, opts: defaultDecodeOptions}
+}
+
+// Creates a parser for the pending data, resuming at its position in the stream.
+func (d *Decoder) parser() *selfParser {
+	if d.at.Line == 0 {
+		return newParser(d.pending, d.opts)
+	}
+
+	p := &selfParser{decodeOptions: d.opts, input: d.pending, base: d.at.Offset}
+	p.lineNumber, p.column, p.byteColumn = d.at.Line, d.at.Column, d.at.ByteColumn
+	p.decodeRune()
+	return p
+}
+
+// Reads more data from the stream, once parsing the pending data has looked
+// at its end.
+// Reading goes on until the pending data has doubled, so that a document
+// arriving in small pieces is parsed a bounded number of times, unless a
+// document separator has been read.
+func (d *Decoder) fill() error {
+	size := len(d.pending)
+	if size < minReadSize {
+		size = minReadSize
+	}
+
+	// A new buffer is allocated as decoded strings may refer to the previous one.
+	buf := make([]byte, len(d.pending), len(d.pending)+size)
+	copy(buf, d.pending)
+	defer func() { d.pending = ownedString(buf) }()
+
+	for empty := 0; ; {
+		room := buf[len(buf):cap(buf)]
+		if d.maxSize > 0 && int64(len(room)) > d.maxSize+1-d.read {
+			room = room[:d.maxSize+1-d.read]
+		}
+
+		n, err := d.r.Read(room)
+		start := len(buf) - len(documentSeparator) + 1
+		if start < 0 {
+			start = 0
+		}
+		buf = buf[:len(buf)+n]
+		d.read += int64(n)
+
+		switch {
+		case d.maxSize > 0 && d.read > d.maxSize:
+			return fmt.Errorf("lsd: stream larger than %d bytes", d.maxSize)
+		case err == io.EOF:
+			d.eof = true
+			return nil
+		case err != nil:
+			return err
+		case n == 0:
+			if empty++; empty == 100 {
+				return io.ErrNoProgress
+			}
+		case len(buf) == cap(buf) || strings.Contains(ownedString(buf[start:]), documentSeparator):
+			return nil
+		}
+	}
+}
+
+// Substitutes invalid UTF-8 sequences with U+FFFD instead of failing.
+// Must be called before decoding the first document.
+func (d *Decoder) ReplaceInvalidUTF8() {
+	d.opts.replaceInvalidUTF8 = true
+}
+
+// Makes slice fields defined several times in a structure accumulate the
+// values of every definition, like `(Depends network) (Depends syslog)`,
+// instead of reporting them as duplicates.
+// Must be called before decoding the first document.
+func (d *Decoder) AccumulateRepeatedFields() {
+	d.opts.accumulateRepeated = true
+}
+
+// Sets a callback receiving parsing and packing events, for debugging purposes.
+// Must be called before decoding the first document.
+func (d *Decoder) SetTracer(tracer Tracer) {
+	d.opts.tracer = tracer
+}
+
+// Sets the policy used to match node heads with structure field names.
+// Must be called before decoding the first document.
+func (d *Decoder) SetKeyMatching(policy KeyMatching) {
+	d.opts.keyMatching = policy
+}
+
+// Sets the maximum nesting level of lists, 10000 by default.
+// Zero disables the limit.
+// Must be called before decoding the first document.
+func (d *Decoder) SetMaxDepth(depth int) {
+	d.opts.maxDepth = depth
+}
+
+// Sets the maximum length in bytes of a string value.
+// Zero, the default, disables the limit.
+// Must be called before decoding the first document.
+func (d *Decoder) SetMaxStringLength(length int) {
+	d.opts.maxStringLength = length
+}
+
+// Sets the maximum size in bytes of the whole stream.
+// Zero, the default, disables the limit.
+// Must be called before decoding the first document.
+func (d *Decoder) SetMaxSize(size int64) {
+	d.maxSize = size
+}
+
+// Reports whether there is another document in the stream.
+// Returns false once a syntax error has been reported, as the following
+// documents cannot be located.
+// Blocks until enough data has been read from the stream to tell.
+func (d *Decoder) More() bool {
+	for d.err == nil {
+		p := d.parser()
+		p.skipDocumentSeparators()
+		if !p.reachedEnd || d.eof {
+			return !p.eod || p.err != nil
+		} else if err := d.fill(); err != nil {
+			return true // Let Decode report the error.
+		}
+	}
+	return false
+}
+
+// Decodes the next document of the stream into the output structure.
+// The output should be a fresh value for each document, as fields absent
+// from the document are left untouched.
+// Returns io.EOF when there are no more documents.
+// After a syntax error, the same error is returned by every call.
+func (d *Decoder) Decode(out interface{}) error {
+	if d.err != nil {
+		return d.err
+	}
+
+	st, err := structOutput(out)
+	if err != nil {
+		return err
+	}
+
+	p, rootNode, err := d.parseDocument()
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		d.err = err
+		return err
+	}
+
+	d.index++
+	if err = p.packDocument(rootNode, st); err != nil {
+		return &documentError{index: d.index, err: err}
+	}
+	return nil
+}
+
+// Parses the next document of the stream, reading data until it is complete.
+// The pending data is then moved after the document.
+func (d *Decoder) parseDocument() (p *selfParser, rootNode *selfNode, err error) {
+	for {
+		if p, rootNode, err = d.tryParseDocument(); p != nil && p.reachedEnd && !d.eof {
+			if err = d.fill(); err != nil {
+				return nil, nil, err
+			}
+			continue
+		} else if err != nil {
+			return
+		}
+
+		d.pending, d.at = p.input[p.pos:], p.position()
+		return
+	}
+}
+
+// Parses the next document of the pending data.
+// Returns io.EOF if there is none. Errors end the stream.
+func (d *Decoder) tryParseDocument() (p *selfParser, rootNode *selfNode, err error) {
+	p = d.parser()
+	defer func() {
+		if err != nil && err != io.EOF {
+			err = &documentError{index: d.index + 1, err: err}
+		}
+	}()
+	defer p.recoverError(&err)
+
+	if p.skipDocumentSeparators(); p.err != nil {
+		return p, nil, p.err
+	} else if p.eod {
+		return p, nil, io.EOF
+	}
+
+	rootNode, err = p.parseDocument()
+	return
 }
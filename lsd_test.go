@@ -0,0 +1,353 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type testEntry struct {
+	Name string
+}
+
+func TestDecoderStream(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("(Name a)\n---\n---\n(Name b)\n---\n"))
+
+	var names []string
+	for dec.More() {
+		var entry testEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, entry.Name)
+	}
+
+	if strings.Join(names, " ") != "a b" {
+		t.Errorf("decoded %q, expected [a b]", names)
+	}
+	if err := dec.Decode(&testEntry{}); err != io.EOF {
+		t.Errorf("got %v after the last document, expected io.EOF", err)
+	}
+}
+
+func TestDecoderPackErrorSkipsDocument(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("(Name a)\n---\n(Other b)\n---\n(Name c)"))
+
+	var errs []string
+	var names []string
+	for dec.More() {
+		var entry testEntry
+		if err := dec.Decode(&entry); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		names = append(names, entry.Name)
+	}
+
+	if strings.Join(names, " ") != "a c" {
+		t.Errorf("decoded %q, expected [a c]", names)
+	}
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], "document 2: ") {
+		t.Errorf("got errors %q, expected one for document 2", errs)
+	}
+}
+
+func TestDecoderSyntaxErrorEndsStream(t *testing.T) {
+	inputs := []string{
+		"(Name a)\n---\n(Name \"bad\\q\")\n---\n(Name c)",
+		"(Name a)\n---\n(Name b\n---\n(Name c)",
+		"(Name a)\n---\n(Name b))\n---\n(Name c)",
+	}
+
+	for _, input := range inputs {
+		dec := NewDecoder(strings.NewReader(input))
+
+		var errs []error
+		for i := 0; dec.More(); i++ {
+			if i == 10 {
+				t.Fatalf("%q: decoder does not stop", input)
+			}
+			if err := dec.Decode(&testEntry{}); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "document 2: ") {
+			t.Errorf("%q: got errors %v, expected one for document 2", input, errs)
+			continue
+		}
+		if err := dec.Decode(&testEntry{}); err == nil || err.Error() != errs[0].Error() {
+			t.Errorf("%q: got %v after the syntax error, expected %v", input, err, errs[0])
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failure")
+}
+
+func TestDecoderReadError(t *testing.T) {
+	dec := NewDecoder(failingReader{})
+	if !dec.More() {
+		t.Fatal("More hides the read error")
+	}
+	for i := 0; i < 2; i++ {
+		if err := dec.Decode(&testEntry{}); err == nil || err.Error() != "read failure" {
+			t.Errorf("got %v, expected the read error", err)
+		}
+	}
+	if dec.More() {
+		t.Error("More reports documents after a read error")
+	}
+}
+
+func TestDecoderReadsIncrementally(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(w, "(Name a)\n---\n")
+		written <- err
+	}()
+
+	dec := NewDecoder(r)
+	var entry testEntry
+	if err := dec.Decode(&entry); err != nil || entry.Name != "a" {
+		t.Fatalf("got %q, %v", entry.Name, err)
+	} else if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		io.WriteString(w, "(Name b)")
+		w.Close()
+	}()
+	if err := dec.Decode(&entry); err != nil || entry.Name != "b" {
+		t.Fatalf("got %q, %v", entry.Name, err)
+	} else if dec.More() {
+		t.Error("More reports documents after the end of the stream")
+	}
+}
+
+// Decodes every document of a stream, returning the names and errors found.
+func decodeStream(r io.Reader) (results []string) {
+	dec := NewDecoder(r)
+	for i := 0; dec.More(); i++ {
+		var entry testEntry
+		if err := dec.Decode(&entry); err != nil {
+			results = append(results, "error: "+err.Error())
+		} else {
+			results = append(results, entry.Name)
+		}
+	}
+	return
+}
+
+func TestDecoderSmallReads(t *testing.T) {
+	inputs := []string{
+		"\uFEFF(Name é)\n---\n(Name \"a\\x41\")---(Name [b]) ; comment\n--- #| c |# ---\n",
+		"(Name <<END\n  END;\n  END\n)\n---\n(Name [=[ ]] ]=])\n---\n(Name ---x)",
+		"(Name a)\n---\n(Other b)\n---\n(Name \"\\q\")\n---\n(Name c)",
+		"(Name a)\n---\n(Name \xff)",
+		"(Name a) #; (Name b)\n---\n#| unterminated",
+	}
+	for _, input := range inputs {
+		expected := decodeStream(strings.NewReader(input))
+		for _, r := range []io.Reader{iotest.OneByteReader(strings.NewReader(input)), iotest.DataErrReader(strings.NewReader(input))} {
+			if got := decodeStream(r); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+				t.Errorf("%q: got\n%s\nexpected\n%s", input, strings.Join(got, "\n"), strings.Join(expected, "\n"))
+			}
+		}
+	}
+}
+
+func TestDecoderReadBoundaries(t *testing.T) {
+	documents := []string{"(Name b)", "(Name é) ; comment", "#| c |# (Name [d])", "(Name <<E\n  E;\n  E\n)"}
+	for filler := minReadSize - 24; filler < minReadSize+8; filler++ {
+		input := "(Name " + strings.Repeat("a", filler) + ")"
+		for _, doc := range documents {
+			input += "\n---\n" + doc
+		}
+
+		got := decodeStream(strings.NewReader(input))
+		if expected := "b é d E;\n"; len(got) != 5 || strings.Join(got[1:], " ") != expected {
+			t.Errorf("filler of %d bytes: got %q", filler, got[1:])
+		}
+	}
+}
+
+func TestDecoderRejectedOutput(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("(Name a)\n---\n(Other b)"))
+	for _, out := range []interface{}{nil, testEntry{}, new(int)} {
+		if err := dec.Decode(out); err == nil || strings.HasPrefix(err.Error(), "document") {
+			t.Errorf("%T: got %v", out, err)
+		}
+	}
+
+	var entry testEntry
+	if err := dec.Decode(&entry); err != nil || entry.Name != "a" {
+		t.Errorf("got %q, %v", entry.Name, err)
+	}
+	if err := dec.Decode(&entry); err == nil || !strings.HasPrefix(err.Error(), "document 2: ") {
+		t.Errorf("got %v, expected an error for document 2", err)
+	}
+}
+
+func TestDecoderPositions(t *testing.T) {
+	dec := NewDecoder(iotest.OneByteReader(strings.NewReader("(Name é)\n---\n  (Name a) (Other b)")))
+	if err := dec.Decode(&testEntry{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := dec.Decode(&testEntry{})
+	expected := Position{Offset: 25, Line: 3, Column: 12, ByteColumn: 12}
+	if perr, ok := errors.Unwrap(err).(*packError); !ok {
+		t.Fatalf("got %v, expected a packing error", err)
+	} else if perr.Position() != expected {
+		t.Errorf("got %+v, expected %+v", perr.Position(), expected)
+	}
+}
+
+func TestLoadStringSingleDocument(t *testing.T) {
+	var entry testEntry
+	if err := LoadString("(Name a)\n---\n(Name b)", &entry); err == nil {
+		t.Error("multiple documents accepted by LoadString")
+	}
+	if err := LoadString("(Name a)\n---\n", &entry); err != nil || entry.Name != "a" {
+		t.Errorf("got %q, %v", entry.Name, err)
+	}
+}
+
+// Decodes the first document of a stream with options set by setup.
+func decodeWith(data string, setup func(*Decoder)) error {
+	dec := NewDecoder(strings.NewReader(data))
+	setup(dec)
+	return dec.Decode(&fuzzConfig{})
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(depth int) string {
+		return "(Raw" + strings.Repeat(" (a", depth-1) + strings.Repeat(")", depth)
+	}
+
+	if err := decodeWith(nested(4), func(dec *Decoder) { dec.SetMaxDepth(4) }); err != nil {
+		t.Errorf("depth 4 rejected: %v", err)
+	}
+	if err := decodeWith(nested(5), func(dec *Decoder) { dec.SetMaxDepth(4) }); err == nil {
+		t.Error("depth 5 accepted with a limit of 4")
+	}
+	if err := decodeWith(nested(2e5), func(dec *Decoder) { dec.SetMaxDepth(0) }); err != nil {
+		t.Errorf("depth 200000 rejected without limit: %v", err)
+	}
+
+	var conf fuzzConfig
+	if err := LoadString(nested(defaultMaxDepth+1), &conf); err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Errorf("got %v, expected a nesting error", err)
+	}
+}
+
+func TestMaxStringLength(t *testing.T) {
+	inputs := []string{"(Name abcdefghi)", `(Name "abcdefghi")`, `(Name "abc\tefghi")`, "(Name [abcdefghi])"}
+	for _, input := range inputs {
+		if err := decodeWith(input, func(dec *Decoder) { dec.SetMaxStringLength(9) }); err != nil {
+			t.Errorf("%q rejected: %v", input, err)
+		}
+		if err := decodeWith(input, func(dec *Decoder) { dec.SetMaxStringLength(8) }); err == nil {
+			t.Errorf("%q accepted with a limit of 8 bytes", input)
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	if err := decodeWith("(Name a)", func(dec *Decoder) { dec.SetMaxSize(8) }); err != nil {
+		t.Errorf("8 bytes rejected: %v", err)
+	}
+
+	dec := NewDecoder(strings.NewReader("(Name a) "))
+	dec.SetMaxSize(8)
+	if err := dec.Decode(&fuzzConfig{}); err == nil {
+		t.Error("9 bytes accepted with a limit of 8")
+	} else if dec.More() {
+		t.Error("documents reported after a size error")
+	}
+}
+
+func TestShortNumbers(t *testing.T) {
+	for _, input := range []string{"(Port 7)", "(Port 0)", "(Count -)", "(Count 0x)", "(Size K)", "(Ratio %)", "(Usage /)"} {
+		var conf fuzzConfig
+		if err := LoadString(input, &conf); err != nil && strings.Contains(err.Error(), "internal error") {
+			t.Errorf("%q: %v", input, err)
+		}
+	}
+}
+
+// Value whose decoding methods panic.
+type panickingValue struct{}
+
+func (*panickingValue) UnmarshalText([]byte) error { panic("text panic") }
+
+type panickingDocument struct{}
+
+func (*panickingDocument) UnmarshalLSD(Node) error { panic("document panic") }
+
+func TestPanicsPropagate(t *testing.T) {
+	var fields struct{ Value panickingValue }
+	tests := []struct {
+		decode   func() error
+		expected interface{}
+	}{
+		{func() error { return LoadString("(Value x)", &fields) }, "text panic"},
+		{func() error { return NewDecoder(strings.NewReader("(Value x)")).Decode(&fields) }, "text panic"},
+		{func() error { return LoadString("(Name x)", &panickingDocument{}) }, "document panic"},
+		{func() error { return NewDecoder(strings.NewReader("(Name x)")).Decode(&panickingDocument{}) }, "document panic"},
+	}
+
+	for i, test := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r != test.expected {
+					t.Errorf("decoding %d: got panic %v, expected %v", i, r, test.expected)
+				}
+			}()
+			err := test.decode()
+			t.Errorf("decoding %d: returned %v instead of panicking", i, err)
+		}()
+	}
+}
+
+func TestInternalErrorRecovered(t *testing.T) {
+	p := newParser("(Name x)", defaultDecodeOptions)
+	err := func() (err error) {
+		defer p.recoverError(&err)
+		internalErrorf("broken %s", "invariant")
+		return nil
+	}()
+
+	if err == nil || !strings.Contains(err.Error(), "internal error: broken invariant") {
+		t.Errorf("got %v, expected an internal error", err)
+	} else if p.err != err || !p.eod {
+		t.Errorf("parser not stopped after an internal error")
+	}
+}
+
+func TestLoadBytesCopiesInput(t *testing.T) {
+	data := []byte("(Name original)")
+	var entry testEntry
+	if err := LoadBytes(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(data, "(Name modified)")
+	if entry.Name != "original" {
+		t.Errorf("decoded string changed with the input to %q", entry.Name)
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/gdelugre/lsd/internal/naming"
+)
+
+// Unmarshaler is implemented by types decoding themselves from a node,
+// like the methods generated by lsd gen-methods.
+// The node is either a list whose values are to be decoded, or a string.
+type Unmarshaler interface {
+	UnmarshalLSD(n Node) error
+}
+
+// Marshaler is implemented by types encoding themselves as a node,
+// like the methods generated by lsd gen-methods.
+// The head of a returned list is replaced by the name of the field holding the value.
+type Marshaler interface {
+	MarshalLSD() (Node, error)
+}
+
+var (
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+)
+
+// Checks whether values of a type decode themselves with an UnmarshalLSD method.
+func isUnmarshaler(t reflect.Type) bool {
+	return t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface && reflect.PtrTo(t).Implements(unmarshalerType)
+}
+
+// Decodes a value into an addressable Go value with its UnmarshalLSD method.
+func unmarshalLSD(ps *packState, value selfValue, v reflect.Value) error {
+	return v.Addr().Interface().(Unmarshaler).UnmarshalLSD(Node{value, ps.decodeOptions})
+}
+
+// Encodes a value with its MarshalLSD method, if it implements Marshaler.
+// Returns false if the value does not implement the interface.
+// Interfaces are left to encodeVariant, which names the concrete type.
+func marshalLSD(v reflect.Value) (value selfValue, ok bool, err error) {
+	if v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr && v.IsNil() {
+		return
+	}
+
+	if !v.Type().Implements(marshalerType) {
+		if !v.CanAddr() || !reflect.PtrTo(v.Type()).Implements(marshalerType) {
+			return
+		}
+		v = v.Addr()
+	}
+
+	var n Node
+	if n, err = v.Interface().(Marshaler).MarshalLSD(); err == nil && n.value == nil {
+		err = fmt.Errorf("lsd: MarshalLSD of type %s returned an empty node", v.Type())
+	}
+	return n.value, true, err
+}
+
+// Fields describes the fields of a structure type to the methods generated by
+// lsd gen-methods.
+// A Fields must not be copied nor modified after its first use.
+type Fields struct {
+	Type       string   // Name of the structure type.
+	Names      []string // Keys of the fields in documents, in declaration order.
+	Repeatable []bool   // Whether each field is a slice accumulating repeated definitions.
+
+	once  sync.Once
+	index nameIndex // Index of Names, built on first use.
+}
+
+// Looks up the fields matching a node head, returning the indexes of the
+// first two matches, or -1 in their absence.
+func (fields *Fields) lookup(key string, policy KeyMatching) (first, second int) {
+	fields.once.Do(func() {
+		fields.index = newNameIndex(fields.Names)
+	})
+	return fields.index.lookup(key, policy)
+}
+
+// Field matched by a value of a list decoded by DecodeFields.
+type fieldMatch struct {
+	first, second int
+}
+
+// Decodes the values of a list into the fields of a structure, calling decode
+// with the index of the field receiving each value.
+// Values are matched by name with the key matching policy of the decoder, or
+// by order unless they are all lists headed by field names, as done by Load.
+// Values of a document root are always matched by name.
+// With Decoder.AccumulateRepeatedFields, repeatable fields may be defined
+// several times, decode being called with repeated set for the definitions
+// following the first one.
+func (n Node) DecodeFields(fields *Fields, decode func(index int, value Node, repeated bool) error) error {
+	node, ok := n.value.(*selfNode)
+	if n.value == nil {
+		return errors.New("lsd: decoding an empty Node")
+	} else if !ok {
+		return n.value.newPackError("cannot pack string `" + n.Text() + "` into field of compound kind struct")
+	}
+
+	// Fields are looked up once, small lists keeping their matches on the stack.
+	var buf [16]fieldMatch
+	matches := buf[:0]
+	if len(node.values) > len(buf) {
+		matches = make([]fieldMatch, 0, len(node.values))
+	}
+	byName := node.isRoot()
+	for _, v := range node.values {
+		match := fieldMatch{-1, -1}
+		if list, ok := v.(*selfNode); ok {
+			match.first, match.second = fields.lookup(list.head.String(), n.opts.keyMatching)
+		}
+		if match.first < 0 && !byName {
+			break
+		}
+		matches = append(matches, match)
+	}
+	byName = byName || len(matches) == len(node.values)
+
+	if !byName {
+		if len(node.values) > len(fields.Names) {
+			return node.newPackError("too many values to fit into struct " + fields.Type)
+		}
+		for i, v := range node.values {
+			if err := decode(i, Node{v, n.opts}, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	nodeName := node.head.String()
+	seen := make([]Position, len(fields.Names))
+	for k, v := range node.values {
+		list, ok := v.(*selfNode)
+		if !ok {
+			return v.newPackError("field `" + nodeName + "` should be only made of lists")
+		}
+
+		fieldName := list.head.String()
+		i := matches[k].first
+		if i < 0 {
+			return list.newPackError("undefined field `" + fieldName + "` for node `" + nodeName + "`")
+		} else if j := matches[k].second; j >= 0 {
+			return list.head.newPackError("ambiguous field `" + fieldName + "` for node `" + nodeName + "`, matching both `" + fields.Names[i] + "` and `" + fields.Names[j] + "`")
+		}
+
+		repeated := seen[i].Line != 0
+		if repeated && !(n.opts.accumulateRepeated && i < len(fields.Repeatable) && fields.Repeatable[i]) {
+			return list.newPackError(fmt.Sprintf("duplicate field `%s` for node `%s`, first defined at line %d", fields.Names[i], nodeName, seen[i].Line))
+		} else if !repeated {
+			seen[i] = list.Pos()
+		}
+
+		if err := decode(i, Node{list, n.opts}, repeated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gets the string of a scalar value, either a string or a list holding a single string.
+func (n Node) scalar() (selfString, error) {
+	switch v := n.value.(type) {
+	case selfString:
+		return v, nil
+	case *selfNode:
+		if len(v.values) != 1 {
+			return selfString{}, v.newPackError("bad number of values for scalar field `" + v.head.String() + "`")
+		} else if str, ok := v.values[0].(selfString); ok {
+			return str, nil
+		}
+		return selfString{}, v.newPackError("expected a string element for scalar field `" + v.head.String() + "`")
+	}
+	return selfString{}, errors.New("lsd: decoding an empty Node")
+}
+
+// Gets the kind of the integers holding bitSize bits, 0 being the size of int.
+func intKind(bitSize int, signed bool) reflect.Kind {
+	kind := reflect.Int
+	switch bitSize {
+	case 8:
+		kind = reflect.Int8
+	case 16:
+		kind = reflect.Int16
+	case 32:
+		kind = reflect.Int32
+	case 64:
+		kind = reflect.Int64
+	}
+
+	if !signed {
+		kind += reflect.Uint - reflect.Int
+	}
+	return kind
+}
+
+// Decodes a scalar value as a string.
+func (n Node) DecodeString() (string, error) {
+	str, err := n.scalar()
+	return str.String(), err
+}
+
+// Decodes a scalar value as a boolean, accepting variations of "yes" and "no".
+func (n Node) DecodeBool() (bool, error) {
+	str, err := n.scalar()
+	if err != nil {
+		return false, err
+	}
+
+	b, err := parseBoolEx(str.String())
+	if err != nil {
+		return false, str.newPackError("cannot convert value `" + str.String() + "` to type bool")
+	}
+	return b, nil
+}
+
+// Decodes a scalar value as a signed integer of bitSize bits, 0 being the size of int.
+func (n Node) DecodeInt(bitSize int) (int64, error) {
+	str, err := n.scalar()
+	if err != nil {
+		return 0, err
+	}
+
+	i, err := parseIntEx(str.String(), bitSize)
+	if err != nil {
+		return 0, str.newConversionError(intKind(bitSize, true), err)
+	}
+	return i, nil
+}
+
+// Decodes a scalar value as an unsigned integer of bitSize bits, 0 being the size of uint.
+func (n Node) DecodeUint(bitSize int) (uint64, error) {
+	str, err := n.scalar()
+	if err != nil {
+		return 0, err
+	}
+
+	u, err := parseUintEx(str.String(), bitSize)
+	if err != nil {
+		return 0, str.newConversionError(intKind(bitSize, false), err)
+	}
+	return u, nil
+}
+
+// Decodes a scalar value as a floating-point number of bitSize bits.
+func (n Node) DecodeFloat(bitSize int) (float64, error) {
+	str, err := n.scalar()
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := strconv.ParseFloat(str.String(), bitSize)
+	if err != nil {
+		kind := reflect.Float64
+		if bitSize == 32 {
+			kind = reflect.Float32
+		}
+		return 0, str.newConversionError(kind, err)
+	}
+	return f, nil
+}
+
+// Decodes a scalar value as a ByteSize.
+func (n Node) DecodeSize() (ByteSize, error) {
+	str, err := n.scalar()
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := parseByteSize(str.String(), 64)
+	if err != nil {
+		return 0, str.newConversionError(reflect.Uint64, err)
+	}
+	return ByteSize(size), nil
+}
+
+// Decodes a scalar value as a Ratio.
+func (n Node) DecodeRatio() (Ratio, error) {
+	str, err := n.scalar()
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := parseRatio(str.String(), 64)
+	if err != nil {
+		return 0, str.newConversionError(reflect.Float64, err)
+	}
+	return Ratio(f), nil
+}
+
+// Gets the number of values of a list decoded into a slice.
+// Fails for strings, which cannot be decoded into slices.
+func (n Node) SliceLen() (int, error) {
+	switch v := n.value.(type) {
+	case *selfNode:
+		return len(v.values), nil
+	case selfString:
+		return 0, v.newPackError("cannot pack string `" + v.String() + "` into field of compound kind slice")
+	}
+	return 0, errors.New("lsd: decoding an empty Node")
+}
+
+// Gets the i-th value following the head of a list.
+// Unlike Values, no slice is allocated.
+// The node must be a list of more than i values, as checked with SliceLen:
+// Index panics otherwise.
+func (n Node) Index(i int) Node {
+	return Node{n.value.(*selfNode).values[i], n.opts}
+}
+
+// Checks an element of a list decoded into a slice.
+// Elements decoded into a structure of type typeName must be lists headed by
+// a bullet point or by the type name, and the others must be strings if
+// typeName is empty.
+func (n Node) CheckElement(typeName string) error {
+	switch v := n.value.(type) {
+	case selfString:
+		if typeName != "" {
+			return v.newPackError("compound kind `struct` expected a list of values")
+		}
+	case *selfNode:
+		if typeName == "" {
+			return v.newPackError("expected a string element for scalar field")
+		} else if head := v.head.String(); !naming.IsBulletPoint(head) && head != typeName {
+			return v.head.newPackError("struct head has value `" + head + "` instead of bullet or `" + typeName + "`")
+		}
+	}
+	return nil
+}
+
+// Decodes the node into out, which must be a non-nil pointer, following the
+// options of a `lsd` structure tag like "name,hex".
+// Decoding follows the options of the Decoder the node was read from.
+func (n Node) DecodeField(out interface{}, tag string) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("lsd: decoding expects a non-nil pointer")
+	} else if n.value == nil {
+		return errors.New("lsd: decoding an empty Node")
+	}
+
+	_, opts := naming.ParseTag(tag)
+	ps := &packState{decodeOptions: n.opts}
+	return n.value.packIntoField(ps, fieldInfo{name: n.Head(), opts: opts}, v.Elem())
+}
+
+// Creates a string node.
+func NewString(str string) Node {
+	return Node{value: selfString{str: str}}
+}
+
+// Creates a list node with a head and values.
+func NewList(head string, values ...Node) Node {
+	node := &selfNode{head: selfString{str: head}, values: make([]selfValue, len(values))}
+	for i, v := range values {
+		node.values[i] = v.value
+	}
+	return Node{value: node}
+}
+
+// Gets a copy of a list with another head.
+// A string becomes the single value of the list.
+func (n Node) WithHead(head string) Node {
+	return Node{encodeParsedValue(head, n.value), n.opts}
+}
+
+// Encodes the value pointed to by ptr as a list with the given head,
+// following the options of a `lsd` structure tag like "name,hex".
+// Returns a node which is not a list if the value is a nil pointer or interface,
+// which Marshal leaves out.
+func MarshalField(head string, ptr interface{}, tag string) (Node, error) {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return Node{}, errors.New("lsd: MarshalField expects a non-nil pointer")
+	}
+
+	_, opts := naming.ParseTag(tag)
+	node, err := encodeNode(head, v.Elem(), opts)
+	if err != nil || node == nil {
+		return Node{}, err
+	}
+	return Node{value: node}, nil
+}
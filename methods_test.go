@@ -0,0 +1,134 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Structure decoded without reflection, as done by the methods of lsd gen-methods.
+type methodsUser struct {
+	Login  string
+	Groups []string
+	Admin  bool
+	Port   uint16
+}
+
+var methodsUserFields = &Fields{
+	Type:       "methodsUser",
+	Names:      []string{"Login", "Groups", "Admin", "port_number"},
+	Repeatable: []bool{false, true, false, false},
+}
+
+func (v *methodsUser) UnmarshalLSD(n Node) error {
+	return n.DecodeFields(methodsUserFields, func(index int, f Node, repeated bool) error {
+		switch index {
+		case 0:
+			x, err := f.DecodeString()
+			v.Login = x
+			return err
+		case 1:
+			count, err := f.SliceLen()
+			if err != nil {
+				return err
+			}
+			for i := 0; i < count; i++ {
+				x, err := f.Index(i).DecodeString()
+				if err != nil {
+					return err
+				}
+				v.Groups = append(v.Groups, x)
+			}
+		case 2:
+			x, err := f.DecodeBool()
+			v.Admin = x
+			return err
+		case 3:
+			x, err := f.DecodeUint(16)
+			v.Port = uint16(x)
+			return err
+		}
+		return nil
+	})
+}
+
+type methodsConfig struct {
+	Users []methodsUser
+}
+
+func TestDecodeFields(t *testing.T) {
+	var conf methodsConfig
+	input := "(Users (- (login a) (Groups x y) (admin yes) (port_number 80)) (- b ([] z) no 8080))"
+	if err := LoadString(input, &conf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[{a [x y] true 80} {b [z] false 8080}]"
+	if got := fmt.Sprint(conf.Users); got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+
+	errors := map[string]string{
+		"(Users (- (Login a) (Login b)))":                                "duplicate field `Login`",
+		"(Users (- (Login a) (Other b) (Admin no) (Port 1) (Groups x)))": "too many values",
+		"(Users (- a ([] x) no 1 extra))":                                "too many values",
+		"(Users (- (Login a) (Groups x)) )":                              "",
+	}
+	for input, message := range errors {
+		var conf methodsConfig
+		err := LoadString(input, &conf)
+		if message == "" && err != nil {
+			t.Errorf("%q: %v", input, err)
+		} else if message != "" && (err == nil || !strings.Contains(err.Error(), message)) {
+			t.Errorf("%q: got %v, expected %q", input, err, message)
+		}
+	}
+}
+
+func TestDecodeFieldsKeyMatching(t *testing.T) {
+	inputs := []struct {
+		policy  KeyMatching
+		input   string
+		message string
+	}{
+		{MatchCapitalized, "(- (login a) (port_number 1))", ""},
+		{MatchCapitalized, "(- (LOGIN a) (port_number 1) (admin no) (groups x) (login b))", "too many values"},
+		{MatchExact, "(- (Login a) (Port_number 1) (Admin no) (Groups x) (Login b))", "too many values"},
+		{MatchCaseInsensitive, "(- (LOGIN a) (PORT_NUMBER 1))", ""},
+		{MatchNormalized, "(- (login a) (PortNumber 1) (port-number 2))", "duplicate field `port_number`"},
+		{MatchNormalized, "(- (l_o_g_i_n a) (portnumber 1))", ""},
+	}
+	for _, test := range inputs {
+		dec := NewDecoder(strings.NewReader("(Users " + test.input + ")"))
+		dec.SetKeyMatching(test.policy)
+		var conf methodsConfig
+		err := dec.Decode(&conf)
+		if test.message == "" && err != nil {
+			t.Errorf("%q: %v", test.input, err)
+		} else if test.message != "" && (err == nil || !strings.Contains(err.Error(), test.message)) {
+			t.Errorf("%q: got %v, expected %q", test.input, err, test.message)
+		}
+	}
+}
+
+func BenchmarkDecodeFields(b *testing.B) {
+	var doc strings.Builder
+	doc.WriteString("(Users\n")
+	for i := 0; i < 1e4; i++ {
+		fmt.Fprintf(&doc, "  (- (login user%d) (groups a b c) (admin no) (port_number %d))\n", i, i%65536)
+	}
+	doc.WriteString(")\n")
+	data := doc.String()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var conf methodsConfig
+		if err := LoadString(data, &conf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"errors"
+	"reflect"
+)
+
+// Node is a value of a parsed document: either a string, or a list made of a
+// head and of nested values.
+type Node struct {
+	value selfValue
+	opts  decodeOptions // Options of the decoder the node was read from.
+}
+
+var nodeType = reflect.TypeOf(Node{})
+
+// Checks whether the node is a list.
+func (n Node) IsList() bool {
+	_, ok := n.value.(*selfNode)
+	return ok
+}
+
+// Gets the head of a list, or an empty string if the node is not a list or
+// is the root of a document.
+func (n Node) Head() string {
+	if node, ok := n.value.(*selfNode); ok && !node.isRoot() {
+		return node.head.String()
+	}
+	return ""
+}
+
+// Gets the value of a string, or an empty string if the node is not a string.
+func (n Node) Text() string {
+	if str, ok := n.value.(selfString); ok {
+		return str.String()
+	}
+	return ""
+}
+
+// Gets the values following the head of a list.
+func (n Node) Values() (values []Node) {
+	if node, ok := n.value.(*selfNode); ok {
+		for _, v := range node.values {
+			values = append(values, Node{v, n.opts})
+		}
+	}
+	return
+}
+
+// Gets the position where the node starts in the document.
+func (n Node) Pos() Position {
+	if n.value == nil {
+		return Position{}
+	}
+	return n.value.Pos()
+}
+
+// Gets the position immediately after the end of the node in the document.
+func (n Node) End() Position {
+	if n.value == nil {
+		return Position{}
+	}
+	return n.value.End()
+}
+
+// Prints the node in LSD syntax.
+func (n Node) String() string {
+	if n.value == nil {
+		return ""
+	}
+	return n.value.Dump(0)
+}
+
+// RawNode holds a value of a document as it was parsed, along with its
+// position, so that it can be decoded later, in the manner of json.RawMessage.
+// Fields of type RawNode are never packed, and are written back unchanged by Marshal.
+type RawNode struct {
+	Node
+}
+
+var rawNodeType = reflect.TypeOf(RawNode{})
+
+// Decodes the value into out, which must be a non-nil pointer.
+// Decoding follows the options of the Decoder the value was read from.
+func (raw RawNode) Decode(out interface{}) error {
+	if raw.value == nil {
+		return errors.New("lsd: decoding an empty RawNode")
+	}
+	return raw.DecodeField(out, "")
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type rawPlugin struct {
+	Kind   string
+	Config RawNode
+}
+
+type rawWebConfig struct {
+	Root string
+	Port int
+}
+
+func TestRawNodeDecode(t *testing.T) {
+	tests := []struct {
+		config   string
+		out      interface{}
+		expected interface{}
+	}{
+		{"(Config (Root /srv) (Port 80))", new(rawWebConfig), &rawWebConfig{"/srv", 80}},
+		{"(Config /srv 80)", new(rawWebConfig), &rawWebConfig{"/srv", 80}},
+		{"(Config 1 2 3)", new([]int), &[]int{1, 2, 3}},
+		{"(Config 1 2)", new([2]uint8), &[2]uint8{1, 2}},
+		{"(Config (a 1) (b 2))", new(map[string]int), &map[string]int{"a": 1, "b": 2}},
+		{"(Config 42)", new(int), newInt(42)},
+		{"(Config \"a b\")", new(string), newString("a b")},
+	}
+
+	for _, test := range tests {
+		var plugin rawPlugin
+		if err := LoadString("(Kind web) "+test.config, &plugin); err != nil {
+			t.Errorf("%s: %v", test.config, err)
+			continue
+		}
+		if err := plugin.Config.Decode(test.out); err != nil {
+			t.Errorf("%s: %v", test.config, err)
+		} else if !reflect.DeepEqual(test.out, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.config, reflect.ValueOf(test.out).Elem(), reflect.ValueOf(test.expected).Elem())
+		}
+
+		var again rawPlugin
+		out, err := Marshal(&plugin)
+		if err != nil {
+			t.Errorf("%s: %v", test.config, err)
+		} else if err = LoadBytes(out, &again); err != nil || again.Config.String() != plugin.Config.String() {
+			t.Errorf("%s: written back as:\n%s", test.config, out)
+		}
+	}
+}
+
+func newInt(i int) *int { return &i }
+
+func newString(s string) *string { return &s }
+
+func TestRawNodeDecodeErrors(t *testing.T) {
+	var plugin rawPlugin
+	if err := LoadString("(Kind web)\n(Config\n  (Root /srv)\n  (Port http))", &plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors refer to the position in the original document.
+	var web rawWebConfig
+	if err := plugin.Config.Decode(&web); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("got %v, expected an error at line 4", err)
+	}
+	if err := plugin.Config.Decode(web); err == nil || !strings.Contains(err.Error(), "non-nil pointer") {
+		t.Errorf("got %v, expected a pointer error", err)
+	}
+	if err := (RawNode{}).Decode(&web); err == nil || !strings.Contains(err.Error(), "empty RawNode") {
+		t.Errorf("got %v, expected an empty node error", err)
+	}
+
+	// Options of the Decoder are kept along with the node.
+	dec := NewDecoder(strings.NewReader("(Config (root /srv) (port 80))"))
+	dec.SetKeyMatching(MatchCaseInsensitive)
+	if err := dec.Decode(&plugin); err != nil {
+		t.Fatal(err)
+	} else if err = plugin.Config.Decode(&web); err != nil || web != (rawWebConfig{"/srv", 80}) {
+		t.Errorf("got %+v, %v", web, err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import "reflect"
+
+// OrderedMap is a map keeping its entries in insertion order.
+// When packed, entries are inserted in the order they appear in the document,
+// and they are written back in the same order. The zero value is an empty map.
+type OrderedMap[K comparable, V any] struct {
+	keys   []K
+	values map[K]V
+}
+
+// Interface implemented by ordered maps, for packing and encoding them without
+// knowing their type parameters.
+type orderedMap interface {
+	mapTypes() (key, elem reflect.Type)
+	entries() (keys, values []reflect.Value)
+	setEntry(key, value reflect.Value)
+	reset()
+}
+
+var orderedMapType = reflect.TypeOf((*orderedMap)(nil)).Elem()
+
+// Checks whether a type is an instance of OrderedMap.
+func isOrderedMap(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && reflect.PtrTo(t).Implements(orderedMapType)
+}
+
+// Gets the value associated with a key.
+func (m *OrderedMap[K, V]) Get(key K) (value V, ok bool) {
+	value, ok = m.values[key]
+	return
+}
+
+// Associates a value with a key. A new key is appended after the existing ones,
+// while an existing key keeps its place.
+func (m *OrderedMap[K, V]) Set(key K, value V) {
+	if m.values == nil {
+		m.values = make(map[K]V)
+	}
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// Removes a key and its value.
+func (m *OrderedMap[K, V]) Delete(key K) {
+	if _, ok := m.values[key]; !ok {
+		return
+	}
+
+	delete(m.values, key)
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Gets the keys in order.
+func (m *OrderedMap[K, V]) Keys() []K {
+	return append([]K(nil), m.keys...)
+}
+
+// Gets the number of entries.
+func (m *OrderedMap[K, V]) Len() int {
+	return len(m.keys)
+}
+
+func (m *OrderedMap[K, V]) mapTypes() (key, elem reflect.Type) {
+	return reflect.TypeOf((*K)(nil)).Elem(), reflect.TypeOf((*V)(nil)).Elem()
+}
+
+func (m *OrderedMap[K, V]) entries() (keys, values []reflect.Value) {
+	for _, k := range m.keys {
+		k, v := k, m.values[k]
+		keys = append(keys, reflect.ValueOf(&k).Elem())
+		values = append(values, reflect.ValueOf(&v).Elem())
+	}
+	return
+}
+
+func (m *OrderedMap[K, V]) setEntry(key, value reflect.Value) {
+	m.Set(key.Interface().(K), value.Interface().(V))
+}
+
+func (m *OrderedMap[K, V]) reset() {
+	m.keys, m.values = nil, nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type orderedSteps struct {
+	Steps OrderedMap[string, []string]
+	Ports OrderedMap[uint16, string]
+}
+
+func TestOrderedMapOrder(t *testing.T) {
+	tests := []struct {
+		input string
+		steps []string
+		ports []uint16
+	}{
+		{"(Steps)", nil, nil},
+		{"(Steps (build make) (test make check) (deploy))", []string{"build", "test", "deploy"}, nil},
+		{"(Steps (z) (a) (m))", []string{"z", "a", "m"}, nil},
+		{"(Ports (443 https) (80 http) (22 ssh))", nil, []uint16{443, 80, 22}},
+	}
+
+	for _, test := range tests {
+		var doc orderedSteps
+		if err := LoadString(test.input, &doc); err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		} else if keys := doc.Steps.Keys(); !reflect.DeepEqual(keys, test.steps) {
+			t.Errorf("%s: got steps %q, expected %q", test.input, keys, test.steps)
+		} else if keys := doc.Ports.Keys(); !reflect.DeepEqual(keys, test.ports) {
+			t.Errorf("%s: got ports %v, expected %v", test.input, keys, test.ports)
+		}
+
+		out, err := Marshal(&doc)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		var decoded orderedSteps
+		if err = LoadBytes(out, &decoded); err != nil {
+			t.Errorf("%s: %v in:\n%s", test.input, err, out)
+		} else if !reflect.DeepEqual(decoded.Steps.Keys(), test.steps) || !reflect.DeepEqual(decoded.Ports.Keys(), test.ports) {
+			t.Errorf("%s: order lost in:\n%s", test.input, out)
+		}
+	}
+
+	var doc orderedSteps
+	if err := LoadString("(Steps (b x) (a y))", &doc); err != nil {
+		t.Fatal(err)
+	} else if value, ok := doc.Steps.Get("a"); !ok || !reflect.DeepEqual(value, []string{"y"}) {
+		t.Errorf("got %q, %v", value, ok)
+	}
+
+	// Packing again replaces the previous entries.
+	if err := LoadString("(Steps (c z))", &doc); err != nil {
+		t.Fatal(err)
+	} else if keys := doc.Steps.Keys(); !reflect.DeepEqual(keys, []string{"c"}) {
+		t.Errorf("got %q, expected [c]", keys)
+	}
+
+	if err := LoadString("(Ports\n  (80 a)\n  (0x50 b))", &doc); err == nil || !strings.Contains(err.Error(), "duplicate key `0x50` in field `Ports`, first defined at line 2") {
+		t.Errorf("got %v, expected a duplicate key error", err)
+	}
+}
+
+func TestOrderedMapMethods(t *testing.T) {
+	var m OrderedMap[string, int]
+	steps := []struct {
+		op    func()
+		keys  []string
+		value int
+	}{
+		{func() {}, nil, 0},
+		{func() { m.Set("b", 1) }, []string{"b"}, 0},
+		{func() { m.Set("a", 2) }, []string{"b", "a"}, 2},
+		{func() { m.Set("b", 3) }, []string{"b", "a"}, 2},
+		{func() { m.Delete("b") }, []string{"a"}, 2},
+		{func() { m.Delete("x") }, []string{"a"}, 2},
+		{func() { m.Set("b", 4) }, []string{"a", "b"}, 2},
+		{func() { m.Delete("a") }, []string{"b"}, 0},
+	}
+
+	for i, step := range steps {
+		step.op()
+		if keys := m.Keys(); !reflect.DeepEqual(keys, step.keys) {
+			t.Errorf("step %d: got keys %q, expected %q", i, keys, step.keys)
+		} else if m.Len() != len(step.keys) {
+			t.Errorf("step %d: got length %d, expected %d", i, m.Len(), len(step.keys))
+		} else if value, _ := m.Get("a"); value != step.value {
+			t.Errorf("step %d: got %d for a, expected %d", i, value, step.value)
+		}
+	}
+}
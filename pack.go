@@ -5,62 +5,92 @@
 package lsd
 
 import (
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"math/big"
 	"reflect"
 	"strconv"
+	"strings"
 	"unicode"
-	"unicode/utf8"
+
+	"github.com/gdelugre/lsd/internal/naming"
 )
 
+// Interface implemented by types unpacking themselves from a string.
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Holds the state shared while packing a document.
+type packState struct {
+	decodeOptions
+}
+
 // Error type that can be triggered while packing values.
 type packError struct {
-	message    string
-	lineNumber uint
+	message string
+	pos     Position
 }
 
 // Generates an error while packing a selfString.
 func (v selfString) newPackError(str string) error {
-	return &packError{message: str, lineNumber: v.LineNumber()}
+	return &packError{message: str, pos: v.Pos()}
 }
 
 // Generates an error while packing a selfNode.
 func (v selfNode) newPackError(str string) error {
-	return &packError{message: str, lineNumber: v.LineNumber()}
+	return &packError{message: str, pos: v.Pos()}
 }
 
 // Error printing.
 func (err packError) Error() (str string) {
 	str = fmt.Sprintf("Error while packing structure: %s", err.message)
-	if err.lineNumber != 0 {
-		str += fmt.Sprintf(" (line %d)", err.lineNumber)
+	if err.pos.Line != 0 {
+		str += fmt.Sprintf(" (%s)", err.pos)
 	}
 	return
 }
 
+// Gets the position of the value which could not be packed.
+func (err packError) Position() Position {
+	return err.pos
+}
+
 // Gets the line number where a node was defined.
 func (node selfNode) LineNumber() uint {
-	return node.lineNumber
+	return node.pos.Line
 }
 
 // Gets the line number where a string value was defined.
 func (str selfString) LineNumber() uint {
-	return str.lineNumber
+	return str.pos.Line
 }
 
-// Capitalize the name of a structure field.
-func publicName(fieldName string) string {
-	if len(fieldName) == 0 {
-		return fieldName
-	} else {
-		return string(unicode.ToUpper(rune(fieldName[0]))) + fieldName[1:]
-	}
+// Gets the position of the opening delimitor of a node.
+func (node selfNode) Pos() Position {
+	return node.pos
+}
+
+// Gets the position immediately after the closing delimitor of a node.
+func (node selfNode) End() Position {
+	return node.end
+}
+
+// Gets the position of the first character of a string value, including quotes or brackets.
+func (str selfString) Pos() Position {
+	return str.pos
+}
+
+// Gets the position immediately after the last character of a string value.
+func (str selfString) End() Position {
+	return str.end
 }
 
 // Checks whether a kind can be packed as a single scalar value.
 func isScalarKind(kind reflect.Kind) bool {
 	switch kind {
 	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map,
-		reflect.Ptr, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128,
+		reflect.Ptr, reflect.UnsafePointer,
 		reflect.Struct, reflect.Slice, reflect.Array:
 		return false
 
@@ -79,184 +109,251 @@ func isCompoundKind(kind reflect.Kind) bool {
 	}
 }
 
-// Allowed node heads to be used as bullet points.
-func isBulletPoint(str string) bool {
-	r, _ := utf8.DecodeRuneInString(str)
-	return r == '-' || r == '*' || r == '•' || r == '◦' || r == '‣' || r == '⁃'
+// Checks whether a type is a slice or array of bytes.
+// Such types are packed from a single base64 or hexadecimal string.
+func isByteSequence(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem().Kind() == reflect.Uint8
 }
 
-// Extended version of strconv.ParseInt.
-// Also accepts binary forms with "0b" prefix.
-func parseIntEx(s string, bitSize int) (int64, error) {
-	if s[0:2] == "0b" {
-		return strconv.ParseInt(s[2:], 2, bitSize)
+// Checks whether a compound type can be packed from a single string.
+func isPackedFromString(t reflect.Type) bool {
+	return isByteSequence(t) || isTextUnmarshaler(t) || t == rawNodeType
+}
+
+// Checks whether a node holds a single string value.
+func (node selfNode) isSingleString() bool {
+	if len(node.values) != 1 {
+		return false
+	}
+	_, ok := node.values[0].(selfString)
+	return ok
+}
+
+// Decodes a base64 string, or a hexadecimal string if prefixed by "hex:" or
+// if the hex tag option is set.
+func decodeBytes(repr string, opts naming.TagOptions) ([]byte, error) {
+	if strings.HasPrefix(repr, "hex:") {
+		return hex.DecodeString(repr[4:])
+	} else if opts.Contains("hex") {
+		return hex.DecodeString(repr)
 	} else {
-		return strconv.ParseInt(s, 0, bitSize)
+		return base64.StdEncoding.DecodeString(repr)
 	}
 }
 
+// Extended version of strconv.ParseInt.
+// Accepts binary "0b", octal "0o" or "0", and hexadecimal "0x" prefixes,
+// as well as underscores between digits like "1_000_000".
+func parseIntEx(s string, bitSize int) (int64, error) {
+	return strconv.ParseInt(s, 0, bitSize)
+}
+
 // Extended version of strconv.ParseUint.
-// Also accepts binary forms with "0b" prefix.
+// Accepts the same prefixes and underscores as parseIntEx.
 func parseUintEx(s string, bitSize int) (uint64, error) {
-	if s[0:2] == "0b" {
-		return strconv.ParseUint(s[2:], 2, bitSize)
-	} else {
-		return strconv.ParseUint(s, 0, bitSize)
+	return strconv.ParseUint(s, 0, bitSize)
+}
+
+// Checks whether values of a type are unpacked from a string by their
+// UnmarshalText method, like big.Int, big.Float and big.Rat.
+func isTextUnmarshaler(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		return t.Implements(textUnmarshalerType)
 	}
+	return reflect.PtrTo(t).Implements(textUnmarshalerType)
 }
 
 // Extended version of strconv.ParseBool.
 // Also accepts variations of "Yes" and "No" strings.
 func parseBoolEx(repr string) (value bool, err error) {
-	if value, err = strconv.ParseBool(repr); err != nil {
-		switch repr {
-		case "y", "yes", "YES", "Yes":
-			return true, nil
-		case "n", "no", "NO", "No":
-			return false, nil
-		}
+	switch repr {
+	case "y", "yes", "YES", "Yes":
+		return true, nil
+	case "n", "no", "NO", "No":
+		return false, nil
 	}
 
-	return
+	return strconv.ParseBool(repr)
 }
 
 // Converts a string to its native non-compound Go type.
-func (str selfString) encodeScalarField(kind reflect.Kind) (interface{}, error) {
-	var item interface{}
+// Integers are read as sizes with the bytesize tag option or the ByteSize type,
+// and floating-point numbers as ratios with the ratio tag option or the Ratio type.
+func (str selfString) encodeScalarField(t reflect.Type, opts naming.TagOptions) (interface{}, error) {
+	value := reflect.New(t).Elem()
+	if err := str.setScalar(value, opts.Contains("bytesize") || t == byteSizeType, opts.Contains("ratio") || t == ratioType); err != nil {
+		return nil, err
+	}
+	return value.Interface(), nil
+}
 
+// Converts a string to the scalar kind of a settable value and stores it.
+// Integers are read as sizes if sizes is set, and floating-point numbers as
+// ratios if ratios is set.
+func (str selfString) setScalar(value reflect.Value, sizes, ratios bool) error {
+	kind := value.Kind()
 	repr := str.String()
+
 	switch kind {
 	case reflect.String:
-		item = repr
+		value.SetString(repr)
 	case reflect.Bool:
-		if b, err := parseBoolEx(repr); err != nil {
-			return nil, str.newPackError("cannot convert value `" + str.String() + "` to type " + kind.String())
-		} else {
-			item = b
+		b, err := parseBoolEx(repr)
+		if err != nil {
+			return str.newPackError("cannot convert value `" + str.String() + "` to type " + kind.String())
 		}
+		value.SetBool(b)
 
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		var bitSize int
-		switch kind {
-		case reflect.Int:
+		bitSize := value.Type().Bits()
+		if kind == reflect.Int {
 			bitSize = 0
-		case reflect.Int8:
-			bitSize = 8
-		case reflect.Int16:
-			bitSize = 16
-		case reflect.Int32:
-			bitSize = 32
-		case reflect.Int64:
-			bitSize = 64
-		}
-		if i, err := parseIntEx(repr, bitSize); err != nil {
-			return nil, str.newPackError("cannot convert value `" + repr + "` to type " + kind.String())
-		} else {
-			switch kind {
-			case reflect.Int:
-				item = int(i)
-			case reflect.Int8:
-				item = int8(i)
-			case reflect.Int16:
-				item = int16(i)
-			case reflect.Int32:
-				item = int32(i)
-			case reflect.Int64:
-				item = int64(i)
+		}
+		var (
+			i   int64
+			err error
+		)
+		if sizes {
+			var u uint64
+			if bitSize == 0 {
+				bitSize = strconv.IntSize
 			}
+			u, err = parseByteSize(repr, bitSize-1)
+			i = int64(u)
+		} else {
+			i, err = parseIntEx(repr, bitSize)
 		}
 
+		if err != nil {
+			return str.newConversionError(kind, err)
+		}
+		value.SetInt(i)
+
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		var bitSize int
-		switch kind {
-		case reflect.Uint:
+		bitSize := value.Type().Bits()
+		if kind == reflect.Uint {
 			bitSize = 0
-		case reflect.Uint8:
-			bitSize = 8
-		case reflect.Uint16:
-			bitSize = 16
-		case reflect.Uint32:
-			bitSize = 32
-		case reflect.Uint64:
-			bitSize = 64
-		}
-		if u, err := parseUintEx(repr, bitSize); err != nil {
-			return nil, str.newPackError("cannot convert value `" + repr + "` to type " + kind.String())
+		}
+		var (
+			u   uint64
+			err error
+		)
+		if sizes {
+			u, err = parseByteSize(repr, bitSize)
 		} else {
-			switch kind {
-			case reflect.Uint:
-				item = uint(u)
-			case reflect.Uint8:
-				item = uint8(u)
-			case reflect.Uint16:
-				item = uint16(u)
-			case reflect.Uint32:
-				item = uint32(u)
-			case reflect.Uint64:
-				item = uint64(u)
-			}
+			u, err = parseUintEx(repr, bitSize)
 		}
 
-	case reflect.Float32:
-		if f, err := strconv.ParseFloat(repr, 32); err != nil {
-			return nil, str.newPackError("cannot convert value `" + str.String() + "` to type " + kind.String())
-		} else {
-			item = float32(f)
+		if err != nil {
+			return str.newConversionError(kind, err)
 		}
-	case reflect.Float64:
-		if f, err := strconv.ParseFloat(repr, 64); err != nil {
-			return nil, str.newPackError("cannot convert value `" + str.String() + "` to type " + kind.String())
+		value.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		bitSize := value.Type().Bits()
+		var (
+			f   float64
+			err error
+		)
+		if ratios {
+			f, err = parseRatio(repr, bitSize)
 		} else {
-			item = f
+			f, err = strconv.ParseFloat(repr, bitSize)
 		}
+
+		if err != nil {
+			return str.newConversionError(kind, err)
+		}
+		value.SetFloat(f)
+
+	case reflect.Complex64, reflect.Complex128:
+		c, err := strconv.ParseComplex(repr, value.Type().Bits())
+		if err != nil {
+			return str.newPackError("cannot convert value `" + str.String() + "` to type " + kind.String())
+		}
+		value.SetComplex(c)
 	}
 
-	return item, nil
+	return nil
+}
+
+// Generates an error when a string cannot be converted to a scalar kind.
+// Details are only reported for errors not coming from the strconv package,
+// which already repeat the value.
+func (str selfString) newConversionError(kind reflect.Kind, err error) error {
+	msg := "cannot convert value `" + str.String() + "` to type " + kind.String()
+	if _, ok := err.(*strconv.NumError); !ok {
+		msg += ": " + err.Error()
+	}
+	return str.newPackError(msg)
 }
 
 // Packs a selfNode into a Go structure/map field.
 // If fhe field is a scalar type, process it with encodeScalarField.
 // If the field is a structure, process it with packToStruct.
-func (node selfNode) packIntoField(name string, field reflect.Value) (err error) {
+func (node selfNode) packIntoField(ps *packState, fi fieldInfo, field reflect.Value) (err error) {
 
+	ps.trace(node, node.head.str, fi.name, field.Type())
 	fieldKind := field.Kind()
 
-	if isScalarKind(fieldKind) {
+	if field.Type() == rawNodeType {
+		field.Set(reflect.ValueOf(RawNode{Node{&node, ps.decodeOptions}}))
+		return nil
+
+	} else if isUnmarshaler(field.Type()) && field.CanAddr() {
+		return unmarshalLSD(ps, &node, field)
+
+	} else if isTextUnmarshaler(field.Type()) || isScalarKind(fieldKind) {
 		if len(node.values) != 1 {
-			return node.newPackError("bad number of values for scalar field `" + name + "`")
+			return node.newPackError("bad number of values for scalar field `" + fi.name + "`")
 		}
 		if _, ok := node.values[0].(selfString); !ok {
-			return node.newPackError("expected a string element for scalar field `" + name + "`")
+			return node.newPackError("expected a string element for scalar field `" + fi.name + "`")
 		}
 		strValue := node.values[0].(selfString)
-		return strValue.packIntoField(name, field)
+		return strValue.packIntoField(ps, fi, field)
+
+	} else if isByteSequence(field.Type()) && node.isSingleString() {
+		return node.values[0].packIntoField(ps, fi, field)
 
 	} else if fieldKind == reflect.Struct {
-		return node.packToStruct(field)
+		return node.packToStruct(ps, field)
 
 	} else if fieldKind == reflect.Array {
-		return node.packToArray(field)
+		return node.packToArray(ps, fi, field)
 
 	} else if fieldKind == reflect.Slice {
-		return node.packToSlice(field)
+		return node.packToSlice(ps, field)
 
 	} else if fieldKind == reflect.Map {
 		field.Set(reflect.MakeMap(field.Type())) // Map requires initialization.
-		return node.packToMap(field)
+		return node.packToMap(ps, field)
+
+	} else if fieldKind == reflect.Interface {
+		if len(node.values) != 1 {
+			return node.newPackError("bad number of values for interface field `" + fi.name + "`")
+		}
+		if _, ok := node.values[0].(*selfNode); !ok {
+			return node.newPackError("expected a list headed by a type name for interface field `" + fi.name + "`")
+		}
+
+		var value reflect.Value
+		if value, err = node.values[0].(*selfNode).makeVariant(ps, field.Type()); err == nil {
+			field.Set(value)
+		}
+		return
 
 	} else {
 		return node.newPackError("unsupported field kind " + fieldKind.String())
 	}
-
-	return
 }
 
 // Packs a selfString into a Go structure/map field.
 // The field type must be scalar to hold the value.
-func (str selfString) packIntoField(_ string, field reflect.Value) (err error) {
+func (str selfString) packIntoField(ps *packState, fi fieldInfo, field reflect.Value) (err error) {
 
 	var value reflect.Value
-	if value, err = str.makeValue(field.Type()); err != nil {
+	if value, err = str.makeFieldValue(ps, fi, field.Type()); err != nil {
 		return
 	}
 
@@ -266,17 +363,36 @@ func (str selfString) packIntoField(_ string, field reflect.Value) (err error) {
 
 // Packs a selfString into a new allocated reflect.Value.
 // This value can later be set into a field or variable.
-func (str selfString) makeValue(t reflect.Type) (value reflect.Value, err error) {
+func (str selfString) makeValue(ps *packState, t reflect.Type) (value reflect.Value, err error) {
+	return str.makeFieldValue(ps, fieldInfo{}, t)
+}
+
+// Packs a selfString into a new allocated reflect.Value, following the tag options of a field.
+func (str selfString) makeFieldValue(ps *packState, fi fieldInfo, t reflect.Type) (value reflect.Value, err error) {
 
-	var item interface{}
 	kind := t.Kind()
 	value = reflect.Zero(t)
+	ps.trace(str, str.str, fi.name, t)
 
-	if isScalarKind(kind) {
-		if item, err = str.encodeScalarField(kind); err != nil {
+	if t == rawNodeType {
+		value = reflect.ValueOf(RawNode{Node{str, ps.decodeOptions}})
+
+	} else if isUnmarshaler(t) {
+		value = reflect.New(t).Elem()
+		err = unmarshalLSD(ps, str, value)
+
+	} else if isTextUnmarshaler(t) {
+		value, err = str.unmarshalText(t)
+
+	} else if isScalarKind(kind) {
+		scalar := reflect.New(t).Elem()
+		if err = str.setScalar(scalar, fi.opts.Contains("bytesize") || t == byteSizeType, fi.opts.Contains("ratio") || t == ratioType); err != nil {
 			return
 		}
-		value = reflect.ValueOf(item)
+		value = scalar
+
+	} else if isByteSequence(t) {
+		value, err = str.makeBytes(t, fi.opts)
 
 	} else if isCompoundKind(kind) {
 		err = str.newPackError("cannot pack string `" + str.String() + "` into field of compound kind " + kind.String())
@@ -288,31 +404,110 @@ func (str selfString) makeValue(t reflect.Type) (value reflect.Value, err error)
 	return
 }
 
+// Gets the precision of a big.Float holding every digit of the mantissa of a
+// number, 4 bits per decimal or hexadecimal digit and no less than 64 bits.
+func bigFloatPrec(repr string) uint {
+	repr = strings.TrimLeft(repr, "+-")
+	hex := strings.HasPrefix(repr, "0x") || strings.HasPrefix(repr, "0X")
+	if hex {
+		repr = repr[2:]
+	}
+
+	var digits uint
+	for _, r := range repr {
+		if r == 'p' || r == 'P' || !hex && (r == 'e' || r == 'E') {
+			break
+		} else if r >= '0' && r <= '9' || hex && unicode.Is(unicode.ASCII_Hex_Digit, r) {
+			digits++
+		}
+	}
+
+	if digits < 16 {
+		return 64
+	}
+	return 4 * digits
+}
+
+// Packs a selfString into a new allocated value of a type implementing encoding.TextUnmarshaler.
+func (str selfString) unmarshalText(t reflect.Type) (value reflect.Value, err error) {
+
+	if t.Kind() == reflect.Ptr {
+		value = reflect.New(t.Elem())
+	} else {
+		value = reflect.New(t)
+	}
+
+	// A big.Float would otherwise get the 64 bits of precision of a float64.
+	if f, ok := value.Interface().(*big.Float); ok {
+		f.SetPrec(bigFloatPrec(str.String()))
+	}
+
+	if err = value.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(str.String())); err != nil {
+		return value, str.newPackError("cannot convert value `" + str.String() + "` to type " + t.String() + ": " + err.Error())
+	}
+
+	if t.Kind() != reflect.Ptr {
+		value = value.Elem()
+	}
+	return
+}
+
+// Packs an encoded selfString into a new allocated slice or array of bytes.
+func (str selfString) makeBytes(t reflect.Type, opts naming.TagOptions) (value reflect.Value, err error) {
+
+	var bytes []byte
+	if bytes, err = decodeBytes(str.String(), opts); err != nil {
+		return value, str.newPackError("cannot decode bytes from value `" + str.String() + "`: " + err.Error())
+	}
+
+	if t.Kind() == reflect.Slice {
+		value = reflect.MakeSlice(t, len(bytes), len(bytes))
+	} else if len(bytes) != t.Len() {
+		return value, str.newPackError(fmt.Sprintf("expected %d bytes, got %d from value `%s`", t.Len(), len(bytes), str.String()))
+	} else {
+		value = reflect.New(t).Elem()
+	}
+
+	reflect.Copy(value, reflect.ValueOf(bytes))
+	return
+}
+
 // Packs a selfNode into a new allocated reflect.Value.
 // This value can later be set into a field or variable.
-func (node selfNode) makeValue(t reflect.Type) (value reflect.Value, err error) {
+func (node selfNode) makeValue(ps *packState, t reflect.Type) (value reflect.Value, err error) {
 
 	kind := t.Kind()
 	value = reflect.Zero(t)
+	ps.trace(node, node.head.str, "", t)
+
+	if t == rawNodeType {
+		value = reflect.ValueOf(RawNode{Node{&node, ps.decodeOptions}})
+
+	} else if isUnmarshaler(t) {
+		value = reflect.New(t).Elem()
+		err = unmarshalLSD(ps, &node, value)
 
-	if isScalarKind(kind) {
+	} else if isScalarKind(kind) {
 		err = node.newPackError("expected a string element for scalar field")
 
 	} else if kind == reflect.Array {
-		value = reflect.MakeSlice(t, t.Len(), t.Len())
-		err = node.packToArray(value)
+		value = reflect.New(t).Elem()
+		err = node.packToArray(ps, fieldInfo{}, value)
 
 	} else if kind == reflect.Slice {
 		value = reflect.New(t).Elem()
-		err = node.packToSlice(value)
+		err = node.packToSlice(ps, value)
 
 	} else if kind == reflect.Struct {
 		value = reflect.New(t).Elem()
-		err = node.packToStruct(value)
+		err = node.packToStruct(ps, value)
 
 	} else if kind == reflect.Map {
 		value = reflect.MakeMap(t)
-		err = node.packToMap(value)
+		err = node.packToMap(ps, value)
+
+	} else if kind == reflect.Interface {
+		value, err = node.makeVariant(ps, t)
 
 	} else {
 		err = node.newPackError("unsupported field kind " + kind.String())
@@ -321,13 +516,38 @@ func (node selfNode) makeValue(t reflect.Type) (value reflect.Value, err error)
 	return
 }
 
+// Packs a selfNode into a new allocated value of the concrete type registered
+// under the node head, which must implement the interface type t.
+func (node selfNode) makeVariant(ps *packState, t reflect.Type) (value reflect.Value, err error) {
+
+	name := node.head.String()
+	concreteType, ok := registeredType(name)
+	if !ok {
+		return reflect.Zero(t), node.head.newPackError("unknown type `" + name + "`")
+	} else if !concreteType.Implements(t) {
+		return reflect.Zero(t), node.head.newPackError("type `" + name + "` does not implement " + t.String())
+	}
+
+	if concreteType.Kind() == reflect.Ptr {
+		value = reflect.New(concreteType.Elem())
+		err = node.packIntoField(ps, fieldInfo{name: name}, value.Elem())
+	} else {
+		value = reflect.New(concreteType).Elem()
+		err = node.packIntoField(ps, fieldInfo{name: name}, value)
+	}
+	return
+}
+
 // Check the header value for a compound type nested into a slice or array.
 func (node *selfNode) checkMetaHeader(elemType reflect.Type) error {
 
 	header := node.head.String()
 	kind := elemType.Kind()
 
-	if kind == reflect.Slice || kind == reflect.Array {
+	if elemType == rawNodeType {
+		// Raw nodes are kept whatever their header.
+
+	} else if kind == reflect.Slice || kind == reflect.Array {
 		// Packing a slice of slices requires the [] (empty string) header.
 		if len(header) != 0 {
 			return node.head.newPackError("slice head has value `" + header + "` instead of []")
@@ -335,7 +555,7 @@ func (node *selfNode) checkMetaHeader(elemType reflect.Type) error {
 
 	} else if kind == reflect.Struct || kind == reflect.Map {
 		// Packing a slice of structs or maps. Requires the type name as header or a bullet point.
-		if !isBulletPoint(header) && header != elemType.Name() {
+		if !naming.IsBulletPoint(header) && header != elemType.Name() {
 			return node.head.newPackError("struct head has value `" + header + "` instead of bullet or `" + elemType.Name() + "`")
 		}
 	}
@@ -344,11 +564,19 @@ func (node *selfNode) checkMetaHeader(elemType reflect.Type) error {
 }
 
 // Packs a selfNode into a Go array.
-func (node *selfNode) packToArray(field reflect.Value) (err error) {
+// Elements left out keep their previous value, unless the exact tag option
+// requires every element to be defined.
+func (node *selfNode) packToArray(ps *packState, fi fieldInfo, field reflect.Value) (err error) {
+
+	if node.isIndexed() {
+		return node.packToArrayByIndex(ps, fi, field)
+	}
 
 	arraySize := field.Type().Len()
 	if len(node.values) > arraySize {
 		return node.newPackError(fmt.Sprintf("too many values to fit into array of %d elements", arraySize))
+	} else if fi.opts.Contains("exact") && len(node.values) < arraySize {
+		return node.newPackError(fmt.Sprintf("not enough values to fill array of %d elements, got %d", arraySize, len(node.values)))
 	}
 
 	arrayType := field.Type().Elem()
@@ -359,6 +587,9 @@ func (node *selfNode) packToArray(field reflect.Value) (err error) {
 		switch arrayKind {
 		case reflect.Slice, reflect.Array, reflect.Struct, reflect.Map:
 			if _, ok := n.(*selfNode); !ok {
+				if isPackedFromString(arrayType) {
+					break
+				}
 				return n.newPackError("compound kind `" + arrayKind.String() + "` expected a list of values")
 			}
 
@@ -368,18 +599,70 @@ func (node *selfNode) packToArray(field reflect.Value) (err error) {
 			}
 		}
 
-		if err = n.packIntoField("", field.Index(i)); err != nil {
+		if err = n.packIntoField(ps, fieldInfo{}, field.Index(i)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Checks whether the values of a selfNode are lists headed by array indexes,
+// like `(Measures (0 12.5) (1023 8.25))`.
+func (node *selfNode) isIndexed() bool {
+	if len(node.values) == 0 {
+		return false
+	}
+
+	for _, n := range node.values {
+		subNode, ok := n.(*selfNode)
+		if !ok {
+			return false
+		}
+		if _, err := strconv.ParseUint(subNode.head.String(), 10, 0); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Packs a selfNode into a Go array, each value being a list headed by the
+// index of the element it defines.
+func (node *selfNode) packToArrayByIndex(ps *packState, fi fieldInfo, field reflect.Value) (err error) {
+
+	arraySize := field.Type().Len()
+	seen := make(map[uint64]Position, len(node.values))
+
+	for _, n := range node.values {
+		subNode := n.(*selfNode)
+		index, indexErr := strconv.ParseUint(subNode.head.String(), 10, 0)
+		if indexErr != nil {
+			internalErrorf("unchecked array index `%s`", subNode.head.String())
+		}
+
+		if index >= uint64(arraySize) {
+			return subNode.head.newPackError(fmt.Sprintf("index %d out of range for array of %d elements", index, arraySize))
+		} else if first, ok := seen[index]; ok {
+			return subNode.head.newPackError(fmt.Sprintf("duplicate index %d, first defined at line %d", index, first.Line))
+		}
+		seen[index] = subNode.Pos()
+
+		if err = subNode.packIntoField(ps, fieldInfo{name: subNode.head.String()}, field.Index(int(index))); err != nil {
 			return
 		}
 	}
 
+	if fi.opts.Contains("exact") && len(seen) < arraySize {
+		return node.newPackError(fmt.Sprintf("not enough values to fill array of %d elements, got %d", arraySize, len(seen)))
+	}
 	return
 }
 
-// Packs a selfNode into a Go slice.
-func (node *selfNode) packToSlice(field reflect.Value) (err error) {
+// Packs a selfNode into a Go slice, replacing its previous content.
+func (node *selfNode) packToSlice(ps *packState, field reflect.Value) (err error) {
 	sliceType := field.Type().Elem()
 	sliceKind := sliceType.Kind()
+	field.Set(reflect.MakeSlice(field.Type(), 0, len(node.values)))
 
 	var value reflect.Value
 	for _, n := range node.values {
@@ -387,6 +670,9 @@ func (node *selfNode) packToSlice(field reflect.Value) (err error) {
 		switch sliceKind {
 		case reflect.Slice, reflect.Array, reflect.Struct, reflect.Map:
 			if _, ok := n.(*selfNode); !ok {
+				if isPackedFromString(sliceType) {
+					break
+				}
 				return n.newPackError("compound kind `" + sliceKind.String() + "` expected a list of values")
 			}
 
@@ -396,7 +682,7 @@ func (node *selfNode) packToSlice(field reflect.Value) (err error) {
 			}
 		}
 
-		if value, err = n.makeValue(sliceType); err != nil {
+		if value, err = n.makeValue(ps, sliceType); err != nil {
 			return
 		}
 
@@ -408,15 +694,25 @@ func (node *selfNode) packToSlice(field reflect.Value) (err error) {
 
 // Packs a selfNode into a Go map.
 // Values must be nodes as their heads are used as keys into the map.
-func (node *selfNode) packToMap(m reflect.Value) (err error) {
+func (node *selfNode) packToMap(ps *packState, m reflect.Value) (err error) {
+	return node.packEntries(ps, m.Type().Key(), m.Type().Elem(), m.SetMapIndex)
+}
+
+// Packs a selfNode into an OrderedMap, keeping the order of the entries.
+func (node *selfNode) packToOrderedMap(ps *packState, om orderedMap) (err error) {
+	om.reset()
+	keyType, elemType := om.mapTypes()
+	return node.packEntries(ps, keyType, elemType, om.setEntry)
+}
+
+// Packs the lists of a selfNode into key-value entries, the heads being
+// converted to the key type. Keys must not be repeated.
+func (node *selfNode) packEntries(ps *packState, keyType, elemType reflect.Type, set func(key, value reflect.Value)) (err error) {
 
-	var (
-		key   interface{}
-		value reflect.Value
-	)
+	var key, value reflect.Value
 
 	nodeName := node.head.String()
-	keyType, elemType := m.Type().Key(), m.Type().Elem()
+	seen := make(map[interface{}]Position, len(node.values))
 
 	for _, n := range node.values {
 		if _, ok := n.(*selfNode); !ok {
@@ -424,61 +720,129 @@ func (node *selfNode) packToMap(m reflect.Value) (err error) {
 		}
 		valueNode := n.(*selfNode)
 		nodeHead := valueNode.head
-		if key, err = nodeHead.encodeScalarField(keyType.Kind()); err != nil {
+		if key, err = nodeHead.makeValue(ps, keyType); err != nil {
 			return
 		}
 
+		if first, ok := seen[key.Interface()]; ok {
+			return nodeHead.newPackError(fmt.Sprintf("duplicate key `%s` in field `%s`, first defined at line %d", nodeHead.String(), nodeName, first.Line))
+		}
+		seen[key.Interface()] = nodeHead.Pos()
+
 		value = reflect.New(elemType).Elem()
-		if err = valueNode.packIntoField(nodeHead.String(), value); err != nil {
+		if err = valueNode.packIntoField(ps, fieldInfo{name: nodeHead.String()}, value); err != nil {
 			return
 		}
 
-		m.SetMapIndex(reflect.ValueOf(key), value)
+		set(key, value)
 	}
 	return
 }
 
 // Packs a selfNode into a Go structure.
 // For each iterated member in the node, fills the corresponding structure field by name.
-func (node *selfNode) packToStructByFieldName(st reflect.Value) (err error) {
+func (node *selfNode) packToStructByFieldName(ps *packState, st reflect.Value) (err error) {
 
 	nodeName := node.head.String()
+	fields := cachedFields(st.Type())
+	var buf [16]Position
+	var seenFields []Position
+	if len(fields.list) > len(buf) {
+		seenFields = make([]Position, len(fields.list))
+	} else {
+		seenFields = buf[:len(fields.list)]
+	}
+	var seenRemain map[string]Position
+
 	for _, n := range node.values {
 		if _, ok := n.(*selfNode); !ok {
 			return n.newPackError("field `" + nodeName + "` should be only made of lists")
 		}
 		valueNode := n.(*selfNode)
-		fieldName := publicName(valueNode.head.String())
-		targetField := st.FieldByName(fieldName)
-		if !targetField.IsValid() {
+		fieldName := valueNode.head.String()
+		i, j := fields.names.lookup(fieldName, ps.keyMatching)
+		if rf := fields.remain; rf != nil && i < 0 {
+			if first, ok := seenRemain[fieldName]; ok {
+				return valueNode.newPackError(fmt.Sprintf("duplicate field `%s` for node `%s`, first defined at line %d", fieldName, nodeName, first.Line))
+			} else if seenRemain == nil {
+				seenRemain = make(map[string]Position)
+			}
+			seenRemain[fieldName] = valueNode.Pos()
+
+			if err = valueNode.packIntoRemain(ps, *rf, st.FieldByIndex(rf.index)); err != nil {
+				return
+			}
+			continue
+		} else if i < 0 {
 			return valueNode.newPackError("undefined field `" + fieldName + "` for node `" + nodeName + "`")
+		} else if j >= 0 {
+			return valueNode.head.newPackError("ambiguous field `" + fieldName + "` for node `" + nodeName + "`, matching both `" + fields.list[i].name + "` and `" + fields.list[j].name + "`")
+		}
+		fi := fields.list[i]
+		field := fieldByIndex(st, fi.index)
+
+		if first := seenFields[i]; first.Line == 0 {
+			seenFields[i] = valueNode.Pos()
+		} else if ps.accumulateRepeated && field.Kind() == reflect.Slice && !isPackedFromString(field.Type()) {
+			// Values of the repeated field are appended to the previous ones.
+			values := reflect.New(field.Type()).Elem()
+			if err = fi.decode(ps, valueNode, fi, values); err != nil {
+				return
+			}
+			field.Set(reflect.AppendSlice(field, values))
+			continue
+		} else {
+			return valueNode.newPackError(fmt.Sprintf("duplicate field `%s` for node `%s`, first defined at line %d", fi.name, nodeName, first.Line))
 		}
 
-		if err = valueNode.packIntoField(fieldName, targetField); err != nil {
+		if err = fi.decode(ps, valueNode, fi, field); err != nil {
 			return
 		}
 	}
 	return nil
 }
 
+// Stores a list which does not match any structure field into the remain field,
+// indexed by its head.
+func (node *selfNode) packIntoRemain(ps *packState, fi fieldInfo, field reflect.Value) error {
+
+	t := field.Type()
+	if !isRemainType(t) {
+		return node.newPackError("remain field must be of type map[string]lsd.Node, map[string]lsd.RawNode or map[string]string, not " + t.String())
+	}
+	ps.trace(node, node.head.str, fi.name, t.Elem())
+
+	value := reflect.ValueOf(Node{node, ps.decodeOptions})
+	if t.Elem() == rawNodeType {
+		value = reflect.ValueOf(RawNode{Node{node, ps.decodeOptions}})
+	} else if t.Elem() != nodeType {
+		value = reflect.ValueOf(node.Dump(0)).Convert(t.Elem())
+	}
+
+	if field.IsNil() {
+		field.Set(reflect.MakeMap(t))
+	}
+	field.SetMapIndex(reflect.ValueOf(node.head.String()).Convert(t.Key()), value)
+	return nil
+}
+
 // Packs a selfNode into a Go structure.
 // For each iterated member in the node, fills the corresponding structure field by order.
-// Node head must match with structure type name (empty string for anonymous struct).
-func (node *selfNode) packToStructByFieldOrder(st reflect.Value) (err error) {
+// Fields promoted from embedded structures take the place of the embedded structure.
+// The node head is not checked here: it names the field holding the structure,
+// like Info in (Info acidburn 2 59.14). The heads of slice and array elements
+// are checked against the element type by checkMetaHeader.
+func (node *selfNode) packToStructByFieldOrder(ps *packState, st reflect.Value) (err error) {
 
 	typeName := st.Type().Name()
-	if st.NumField() < len(node.values) {
+	fields := typeFields(st.Type())
+	if len(fields) < len(node.values) {
 		return node.newPackError("too many values to fit into struct " + typeName)
 	}
 
-	nodeName := node.head.String()
-	if !isBulletPoint(nodeName) && typeName != nodeName {
-		return node.newPackError("bad value `" + nodeName + "`, expected `" + typeName + "`")
-	}
-
 	for i, n := range node.values {
-		targetField := st.Field(i)
-		if err = n.packIntoField("", targetField); err != nil {
+		targetField := fieldByIndex(st, fields[i].index)
+		if err = fields[i].decode(ps, n, fields[i], targetField); err != nil {
 			return
 		}
 	}
@@ -487,18 +851,26 @@ func (node *selfNode) packToStructByFieldOrder(st reflect.Value) (err error) {
 
 // Packs a selfNode into a Go structure.
 // If the node only contains subnodes and their heads match field names, consider filling each field by name.
-func (node *selfNode) packToStruct(st reflect.Value) error {
+// Structures with a remain field accept any head.
+func (node *selfNode) packToStruct(ps *packState, st reflect.Value) error {
+
+	if st.CanAddr() && isOrderedMap(st.Type()) {
+		return node.packToOrderedMap(ps, st.Addr().Interface().(orderedMap))
+	}
 
+	fields := cachedFields(st.Type())
 	for _, n := range node.values {
 		switch n.(type) {
 		case selfString:
-			return node.packToStructByFieldOrder(st)
+			return node.packToStructByFieldOrder(ps, st)
 
 		case *selfNode:
-			if !st.FieldByName(n.(*selfNode).head.String()).IsValid() {
-				return node.packToStructByFieldOrder(st)
+			if fields.remain != nil {
+				break
+			} else if i, _ := fields.names.lookup(n.(*selfNode).head.String(), ps.keyMatching); i < 0 {
+				return node.packToStructByFieldOrder(ps, st)
 			}
 		}
 	}
-	return node.packToStructByFieldName(st)
+	return node.packToStructByFieldName(ps, st)
 }
@@ -0,0 +1,565 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type playerInfo struct {
+	UserName     string
+	CurrentLevel int
+	Score        float32
+}
+
+type playerProfile struct {
+	Info    playerInfo
+	Players []playerInfo
+	Ranking [2]playerInfo
+}
+
+func TestPackStructByOrder(t *testing.T) {
+	var profile playerProfile
+	if err := LoadString("(Info acidburn 2 59.14)", &profile); err != nil {
+		t.Fatal(err)
+	} else if profile.Info != (playerInfo{"acidburn", 2, 59.14}) {
+		t.Errorf("got %+v", profile.Info)
+	}
+
+	input := "(Players (- a 1 2) (playerInfo b 3 4)) (Ranking (* c 5 6))"
+	if err := LoadString(input, &profile); err != nil {
+		t.Fatal(err)
+	} else if len(profile.Players) != 2 || profile.Players[1].UserName != "b" || profile.Ranking[0].Score != 6 {
+		t.Errorf("got %+v", profile)
+	}
+
+	for _, input := range []string{"(Players (Bogus a 1 2))", "(Players (Bogus (UserName a)))", "(Ranking (Bogus a 1 2))"} {
+		err := LoadString(input, &playerProfile{})
+		if err == nil || !strings.Contains(err.Error(), "instead of bullet or `playerInfo`") {
+			t.Errorf("%s: got %v, expected a head error", input, err)
+		}
+	}
+}
+
+type benchmarkServer struct {
+	Name    string
+	Port    uint16
+	Weight  float64
+	Enabled bool
+	Cache   ByteSize
+	Share   float32 `lsd:",ratio"`
+	Tags    []string
+	Owner   playerInfo
+}
+
+type benchmarkServers struct {
+	Servers []benchmarkServer
+}
+
+// Decodes slices of 10,000 structures with reflection, their fields being
+// given by name or by order.
+func BenchmarkLoadStructs(b *testing.B) {
+	byName, byOrder := "(Servers\n", "(Servers\n"
+	for i := 0; i < 1e4; i++ {
+		byName += fmt.Sprintf("  (- (name srv%d) (port %d) (weight 0.5) (enabled yes) (cache 4MiB) (share 25%%) (tags a b) (owner (UserName u) (CurrentLevel 2) (Score 1.5)))\n", i, i%65536)
+		byOrder += fmt.Sprintf("  (- srv%d %d 0.5 yes 4MiB 25%% ([] a b) (owner u 2 1.5))\n", i, i%65536)
+	}
+
+	for _, doc := range []struct{ name, data string }{{"name", byName + ")"}, {"order", byOrder + ")"}} {
+		b.Run(doc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(doc.data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var servers benchmarkServers
+				if err := LoadString(doc.data, &servers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type scalarFields struct {
+	Size    int `lsd:",bytesize"`
+	Limit   ByteSize
+	Usage   float32 `lsd:",ratio"`
+	Share   Ratio
+	Level   int8
+	Mask    uint16
+	Enabled bool
+	Signal  complex64
+	Name    playerName
+}
+
+type playerName string
+
+func TestScalarFields(t *testing.T) {
+	var fields scalarFields
+	input := "(Size 2KiB) (Limit 1MB) (Usage 25%) (Share 50%) (Level -3) (Mask 0x10) (Enabled yes) (Signal 1+2i) (Name n)"
+	if err := LoadString(input, &fields); err != nil {
+		t.Fatal(err)
+	}
+	expected := scalarFields{2048, 1e6, 0.25, 0.5, -3, 16, true, 1 + 2i, "n"}
+	if fields != expected {
+		t.Errorf("got %+v, expected %+v", fields, expected)
+	}
+
+	byOrder := "(- 2KiB 1MB 25% 50% -3 0x10 yes 1+2i n)"
+	var list struct{ Fields []scalarFields }
+	if err := LoadString("(Fields "+byOrder+")", &list); err != nil {
+		t.Fatal(err)
+	} else if len(list.Fields) != 1 || list.Fields[0] != expected {
+		t.Errorf("got %+v, expected %+v", list.Fields, expected)
+	}
+
+	errors := map[string]string{
+		"(Level 128)":     "cannot convert value `128` to type int8",
+		"(Mask -1)":       "cannot convert value `-1` to type uint16",
+		"(Size 8EiB)":     "cannot convert value `8EiB` to type int",
+		"(Enabled maybe)": "cannot convert value `maybe` to type bool",
+		"(Level 1 2)":     "bad number of values for scalar field `Level`",
+		"(Level (1))":     "expected a string element for scalar field `Level`",
+	}
+	for input, message := range errors {
+		if err := LoadString(input, &fields); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: got %v, expected %q", input, err, message)
+		}
+	}
+}
+
+func TestScalarFieldsTrace(t *testing.T) {
+	var events []string
+	dec := NewDecoder(strings.NewReader("(Level 3)"))
+	dec.SetTracer(func(ev TraceEvent) {
+		if ev.Kind == TracePack {
+			events = append(events, ev.String())
+		}
+	})
+	if err := dec.Decode(&scalarFields{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`pack "Level" (line 1, column 1) into int8 field Level`,
+		`pack "3" (line 1, column 8) into int8 field Level`,
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got events:\n%s\nexpected:\n%s", strings.Join(events, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+type embeddedBase struct {
+	Name  string
+	Level int
+}
+
+type embeddedOther struct {
+	Level int
+	Score float64
+}
+
+type embeddedTagged struct {
+	Score float64 `lsd:"Score"`
+	Extra string
+}
+
+type embeddedLimits struct {
+	Max int
+}
+
+type embeddedLogging struct {
+	File string
+}
+
+// Exported, so that pointers to them can be allocated when embedded.
+type Endpoint struct {
+	Host string
+	Port int
+}
+
+type Chain struct {
+	*Chain
+	Depth int
+}
+
+func TestEmbeddedFields(t *testing.T) {
+	type promoted struct {
+		embeddedBase
+		Port int
+	}
+	type pointer struct {
+		*Endpoint
+		Name string
+	}
+	type unexportedPointer struct {
+		*embeddedBase
+		Port int
+	}
+	type inline struct {
+		Port   int
+		Limits embeddedLimits `lsd:",inline"`
+	}
+	type named struct {
+		Endpoint `lsd:"Server"`
+		Name     string
+	}
+	type shallower struct {
+		embeddedBase
+		Name string
+	}
+	type conflicting struct {
+		embeddedBase
+		embeddedOther
+	}
+	type taggedPriority struct {
+		embeddedOther
+		embeddedTagged
+	}
+	type deeper struct {
+		conflicting
+		Level int
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		out      interface{}
+		expected interface{}
+	}{
+		{"promotion", "(Name a) (Level 2) (Port 80)", &promoted{}, &promoted{embeddedBase{"a", 2}, 80}},
+		{"promotion by order", "(- a 2 80)", &promoted{}, &promoted{embeddedBase{"a", 2}, 80}},
+		{"pointer", "(Host h) (Name a)", &pointer{}, &pointer{&Endpoint{Host: "h"}, "a"}},
+		{"pointer by order", "(- h 80 a)", &pointer{}, &pointer{&Endpoint{"h", 80}, "a"}},
+		{"unexported pointer", "(Port 80)", &unexportedPointer{}, &unexportedPointer{nil, 80}},
+		{"inline", "(Port 80) (Max 3)", &inline{}, &inline{80, embeddedLimits{3}}},
+		{"named", "(Server (Host h) (Port 80)) (Name a)", &named{}, &named{Endpoint{"h", 80}, "a"}},
+		{"shallower", "(Name a) (Level 2)", &shallower{}, &shallower{embeddedBase{Level: 2}, "a"}},
+		{"conflicting", "(Name a) (Score 1.5)", &conflicting{}, &conflicting{embeddedBase{Name: "a"}, embeddedOther{Score: 1.5}}},
+		{"conflicting by order", "(- a 1.5)", &conflicting{}, &conflicting{embeddedBase{Name: "a"}, embeddedOther{Score: 1.5}}},
+		{"tagged", "(Level 2) (Score 1.5) (Extra x)", &taggedPriority{}, &taggedPriority{embeddedOther{Level: 2}, embeddedTagged{1.5, "x"}}},
+		{"deeper", "(Name a) (Level 2)", &deeper{}, &deeper{conflicting{embeddedBase: embeddedBase{Name: "a"}}, 2}},
+		{"cycle", "(Depth 3)", &Chain{}, &Chain{Depth: 3}},
+		{"cycle by order", "(- 3)", &Chain{}, &Chain{Depth: 3}},
+	}
+
+	for _, test := range tests {
+		// Values given by order are read from a slice element.
+		if strings.HasPrefix(test.input, "(-") {
+			slice := reflect.New(reflect.SliceOf(reflect.TypeOf(test.out).Elem()))
+			holder := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "Items", Type: slice.Type().Elem()}}))
+			if err := LoadString("(Items "+test.input+")", holder.Interface()); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				continue
+			}
+			items := holder.Elem().Field(0)
+			if items.Len() != 1 || !reflect.DeepEqual(items.Index(0).Addr().Interface(), test.expected) {
+				t.Errorf("%s: got %+v, expected %+v", test.name, items.Interface(), test.expected)
+			}
+			continue
+		}
+
+		if err := LoadString(test.input, test.out); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(test.out, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v", test.name, test.out, test.expected)
+		}
+
+		out, err := Marshal(test.expected)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		decoded := reflect.New(reflect.TypeOf(test.out).Elem()).Interface()
+		if err = LoadBytes(out, decoded); err != nil {
+			t.Errorf("%s: %v in:\n%s", test.name, err, out)
+		} else if !reflect.DeepEqual(decoded, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v from:\n%s", test.name, decoded, test.expected, out)
+		}
+	}
+}
+
+func TestEmbeddedConflictingFieldsDropped(t *testing.T) {
+	type conflicting struct {
+		embeddedBase
+		embeddedOther
+	}
+
+	var c conflicting
+	if err := LoadString("(Level 2)", &c); err == nil || !strings.Contains(err.Error(), "undefined field `Level`") {
+		t.Errorf("got %+v, %v, expected an undefined field error", c, err)
+	}
+	var list struct{ Items []conflicting }
+	if err := LoadString("(Items (- a 1.5 2))", &list); err == nil || !strings.Contains(err.Error(), "too many values") {
+		t.Errorf("got %+v, %v, expected too many values", list, err)
+	}
+
+	out, err := Marshal(&conflicting{embeddedBase{"a", 2}, embeddedOther{3, 1.5}})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(out) != "(Name a)\n(Score 1.5)\n" {
+		t.Errorf("got %q", out)
+	}
+}
+
+type remainNodes struct {
+	Name    string
+	Unknown map[string]Node `lsd:",remain"`
+}
+
+type remainStrings struct {
+	Name    string
+	Port    int
+	Unknown map[string]string `lsd:",remain"`
+}
+
+func TestRemainFields(t *testing.T) {
+	tests := []struct {
+		input   string
+		out     interface{}
+		unknown map[string]string
+		marshal string
+	}{
+		{
+			"(Name a) (Color red) (Limits (Max 3) (Min 1))",
+			&remainNodes{},
+			map[string]string{"Color": "(Color red)", "Limits": "(Limits\n    (Max 3)\n    (Min 1))"},
+			"(Name a)\n(Color red)\n(Limits\n    (Max 3)\n    (Min 1))\n",
+		},
+		{
+			"(Extra \"x y\") (Name a) (Port 80) (Flags)",
+			&remainStrings{},
+			map[string]string{"Extra": "(Extra \"x y\")", "Flags": "(Flags)"},
+			"(Name a)\n(Port 80)\n(Extra \"x y\")\n(Flags)\n",
+		},
+	}
+
+	for _, test := range tests {
+		if err := LoadString(test.input, test.out); err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+
+		unknown := make(map[string]string)
+		switch out := test.out.(type) {
+		case *remainNodes:
+			for head, node := range out.Unknown {
+				unknown[head] = node.String()
+			}
+		case *remainStrings:
+			unknown = out.Unknown
+		}
+		if !reflect.DeepEqual(unknown, test.unknown) {
+			t.Errorf("%s: got %q, expected %q", test.input, unknown, test.unknown)
+		}
+
+		out, err := Marshal(test.out)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		} else if string(out) != test.marshal {
+			t.Errorf("%s: got %q, expected %q", test.input, out, test.marshal)
+		}
+
+		decoded := reflect.New(reflect.TypeOf(test.out).Elem()).Interface()
+		if err = LoadBytes(out, decoded); err != nil {
+			t.Errorf("%s: %v in:\n%s", test.input, err, out)
+		} else if again, _ := Marshal(decoded); string(again) != test.marshal {
+			t.Errorf("%s: got %q after a round trip, expected %q", test.input, again, test.marshal)
+		}
+	}
+}
+
+type mapRegion string
+
+type mapKeys struct {
+	Regions map[mapRegion]int
+	Hosts   map[netip.Addr]string
+	Ports   map[uint16]bool
+	Levels  map[playerLevel]string
+}
+
+// Level read from its name, as a map key implementing encoding.TextUnmarshaler.
+type playerLevel int
+
+func (l *playerLevel) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "low":
+		*l = 1
+	case "high":
+		*l = 2
+	default:
+		return fmt.Errorf("unknown level %q", text)
+	}
+	return nil
+}
+
+func (l playerLevel) MarshalText() ([]byte, error) {
+	return []byte(map[playerLevel]string{1: "low", 2: "high"}[l]), nil
+}
+
+func TestMapKeys(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected mapKeys
+	}{
+		{"(Regions (eu 1) (us 2))", mapKeys{Regions: map[mapRegion]int{"eu": 1, "us": 2}}},
+		{
+			"(Hosts (10.0.0.1 a) (::1 b))",
+			mapKeys{Hosts: map[netip.Addr]string{netip.MustParseAddr("10.0.0.1"): "a", netip.MustParseAddr("::1"): "b"}},
+		},
+		{"(Ports (22 yes) (0x50 no))", mapKeys{Ports: map[uint16]bool{22: true, 80: false}}},
+		{"(Levels (low l) (high h))", mapKeys{Levels: map[playerLevel]string{1: "l", 2: "h"}}},
+	}
+
+	for _, test := range tests {
+		var keys mapKeys
+		if err := LoadString(test.input, &keys); err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		} else if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v", test.input, keys, test.expected)
+		}
+
+		out, err := Marshal(&keys)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		// Absent maps are written empty, hence the comparison of outputs.
+		var decoded mapKeys
+		if err = LoadBytes(out, &decoded); err != nil {
+			t.Errorf("%s: %v in:\n%s", test.input, err, out)
+		} else if again, _ := Marshal(&decoded); string(again) != string(out) {
+			t.Errorf("%s: got:\n%s\nexpected:\n%s", test.input, again, out)
+		}
+	}
+}
+
+func TestMapKeysErrors(t *testing.T) {
+	errors := map[string]string{
+		"(Hosts (10.0.0.256 a))":           "10.0.0.256",
+		"(Ports (70000 yes))":              "cannot convert value `70000` to type uint16",
+		"(Levels (medium m))":              "unknown level \"medium\"",
+		"(Regions (eu 1) 2)":               "field `Regions` should be only made of lists",
+		"(Regions\n  (eu 1)\n  (eu 2))":    "duplicate key `eu` in field `Regions`, first defined at line 2 (line 3, column 4)",
+		"(Ports\n  (80 yes)\n  (0x50 no))": "duplicate key `0x50` in field `Ports`, first defined at line 2 (line 3, column 4)",
+		"(Hosts\n  (::1 a)\n  (0:0::1 b))": "duplicate key `0:0::1` in field `Hosts`, first defined at line 2 (line 3, column 4)",
+	}
+
+	for input, message := range errors {
+		if err := LoadString(input, &mapKeys{}); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: got %v, expected %q", input, err, message)
+		}
+	}
+}
+
+type repeatedFields struct {
+	Name    string
+	Depends []string
+	Ports   []uint16
+	Key     []byte
+	Owner   playerInfo
+	Limits  map[string]int
+	Unknown map[string]string `lsd:",remain"`
+}
+
+func TestRepeatedFields(t *testing.T) {
+	tests := []struct {
+		input      string
+		accumulate bool
+		expected   repeatedFields
+		err        string
+	}{
+		{"(Name a)\n(Name b)", false, repeatedFields{}, "duplicate field `Name` for node `root`, first defined at line 1 (line 2, column 1)"},
+		{"(Name a)\n(Name b)", true, repeatedFields{}, "duplicate field `Name` for node `root`, first defined at line 1 (line 2, column 1)"},
+		{"(Depends network)\n(Depends syslog ntp)", false, repeatedFields{}, "duplicate field `Depends` for node `root`, first defined at line 1 (line 2, column 1)"},
+		{"(Depends network)\n(Depends syslog ntp)", true, repeatedFields{Depends: []string{"network", "syslog", "ntp"}}, ""},
+		{"(Depends)\n(Depends a)\n(depends)", true, repeatedFields{Depends: []string{"a"}}, ""},
+		{"(Ports 80)\n(Name a)\n(Ports 443 8080)", true, repeatedFields{Name: "a", Ports: []uint16{80, 443, 8080}}, ""},
+		{"(Ports 80)\n(Ports x)", true, repeatedFields{}, "cannot convert value `x` to type uint16"},
+		{"(Key YQ==)\n(Key Yg==)", true, repeatedFields{}, "duplicate field `Key` for node `root`, first defined at line 1 (line 2, column 1)"},
+		{"(Owner a 1 2)\n\n(Owner b 3 4)", true, repeatedFields{}, "duplicate field `Owner` for node `root`, first defined at line 1 (line 3, column 1)"},
+		{"(Limits (a 1))\n(Limits (b 2))", true, repeatedFields{}, "duplicate field `Limits` for node `root`, first defined at line 1 (line 2, column 1)"},
+		{"(Color red)\n(Color blue)", true, repeatedFields{}, "duplicate field `Color` for node `root`, first defined at line 1 (line 2, column 1)"},
+		{"(Owner (UserName a) (UserName b))", true, repeatedFields{}, "duplicate field `UserName` for node `Owner`, first defined at line 1 (line 1, column 21)"},
+	}
+
+	for _, test := range tests {
+		var fields repeatedFields
+		dec := NewDecoder(strings.NewReader(test.input))
+		if test.accumulate {
+			dec.AccumulateRepeatedFields()
+		}
+		err := dec.Decode(&fields)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q (accumulate %v): got %v, expected %q", test.input, test.accumulate, err, test.err)
+			}
+		} else if err != nil {
+			t.Errorf("%q (accumulate %v): %v", test.input, test.accumulate, err)
+		} else if !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("%q (accumulate %v): got %+v, expected %+v", test.input, test.accumulate, fields, test.expected)
+		}
+	}
+}
+
+type arrayFields struct {
+	Chroot   [3]string `lsd:",exact"`
+	Triple   [3]int
+	Measures [8]float64
+	Matrix   [2][2]int
+	Exact    [2][2]int `lsd:",exact"`
+	Grid     [][2]int
+}
+
+func TestArrayFields(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected arrayFields
+		err      string
+	}{
+		{"(Chroot /srv www 0755)", arrayFields{Chroot: [3]string{"/srv", "www", "0755"}}, ""},
+		{"(Chroot /srv www)", arrayFields{}, "not enough values to fill array of 3 elements, got 2 (line 1, column 1)"},
+		{"(Chroot)", arrayFields{}, "not enough values to fill array of 3 elements, got 0"},
+		{"(Chroot a b c d)", arrayFields{}, "too many values to fit into array of 3 elements"},
+		{"(Triple 1 2)", arrayFields{Triple: [3]int{1, 2, 0}}, ""},
+		{"(Triple 1 2 3 4)", arrayFields{}, "too many values to fit into array of 3 elements"},
+
+		{"(Measures (1 3.5) (7 2.25))", arrayFields{Measures: [8]float64{1: 3.5, 7: 2.25}}, ""},
+		{"(Measures\n  (1 3.5)\n  (8 2.25))", arrayFields{}, "index 8 out of range for array of 8 elements (line 3, column 4)"},
+		{"(Measures\n  (1 3.5)\n  (01 2.25))", arrayFields{}, "duplicate index 1, first defined at line 2 (line 3, column 4)"},
+		{"(Chroot (0 a) (2 c) (1 b))", arrayFields{Chroot: [3]string{"a", "b", "c"}}, ""},
+		{"(Chroot (0 a) (2 c))", arrayFields{}, "not enough values to fill array of 3 elements, got 2"},
+
+		{"(Matrix ([] 1 2) ([] 3 4))", arrayFields{Matrix: [2][2]int{{1, 2}, {3, 4}}}, ""},
+		{"(Matrix ([] 1) ([] 3 4))", arrayFields{Matrix: [2][2]int{{1, 0}, {3, 4}}}, ""},
+		{"(Matrix ([] 1 2 3))", arrayFields{}, "too many values to fit into array of 2 elements"},
+		{"(Matrix (x 1 2))", arrayFields{}, "slice head has value `x` instead of []"},
+		{"(Matrix 1 2)", arrayFields{}, "compound kind `array` expected a list of values"},
+		{"(Matrix (1 (0 5)))", arrayFields{Matrix: [2][2]int{1: {5, 0}}}, ""},
+		// Like other tag options, exact does not apply to the elements.
+		{"(Exact ([] 1 2) ([] 3))", arrayFields{Exact: [2][2]int{{1, 2}, {3, 0}}}, ""},
+		{"(Exact ([] 1 2))", arrayFields{}, "not enough values to fill array of 2 elements, got 1"},
+		{"(Grid ([] 1 2) ([] 3))", arrayFields{Grid: [][2]int{{1, 2}, {3, 0}}}, ""},
+	}
+
+	for _, test := range tests {
+		var fields arrayFields
+		err := LoadString(test.input, &fields)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got %v, expected %q", test.input, err, test.err)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+		} else if !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("%q: got %+v, expected %+v", test.input, fields, test.expected)
+		}
+	}
+}
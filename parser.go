@@ -7,6 +7,7 @@ package lsd
 import (
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -16,66 +17,135 @@ import (
 const sexprOpen = '('
 const sexprClose = ')'
 
+// Separator between documents of a stream.
+const documentSeparator = "---"
+
+// Byte order mark, skipped at the beginning of the stream.
+const byteOrderMark = "\uFEFF"
+
 // End of line and white characters.
 const endOfLine = '\n'
 const whiteSpaces = "\t\r\n\f\u00a0\u0085"
 
+// Position of an element in a self-ml document.
+type Position struct {
+	Offset     int  // Byte offset, starting at 0.
+	Line       uint // Line number, starting at 1.
+	Column     uint // Column number in runes, starting at 1.
+	ByteColumn uint // Column number in bytes, starting at 1.
+}
+
 // Structure returned when a parsing error occurs.
 type parserError struct {
-	message    string
-	lineNumber uint
+	message string
+	pos     Position
 }
 
 // Interface for representing a generic element in a S-expr.
 type selfValue interface {
 	newPackError(string) error
-	packIntoField(string, reflect.Value) error
-	makeValue(reflect.Type) (reflect.Value, error)
+	packIntoField(*packState, fieldInfo, reflect.Value) error
+	makeValue(*packState, reflect.Type) (reflect.Value, error)
 	Dump(int) string
+	dump(*strings.Builder, int)
 	LineNumber() uint
+	Pos() Position
+	End() Position
 }
 
 // String value in a S-expr.
 type selfString struct {
-	str        string
-	lineNumber uint
+	str string
+	pos Position
+	end Position
 }
 
 // S-expr value in a S-expr, must start with a selfString.
 type selfNode struct {
-	head       selfString
-	values     []selfValue
-	lineNumber uint
-	root       bool
+	head   selfString
+	values []selfValue
+	pos    Position
+	end    Position
+	root   bool
 }
 
+// Default maximum nesting level of lists.
+const defaultMaxDepth = 10000
+
+// Options controlling the decoding behaviour, shared by the parser and the packer.
+// Limits set to zero are disabled.
+type decodeOptions struct {
+	replaceInvalidUTF8 bool
+	maxDepth           int
+	maxStringLength    int
+	tracer             Tracer
+	keyMatching        KeyMatching
+	accumulateRepeated bool
+}
+
+// Options used when none are specified.
+var defaultDecodeOptions = decodeOptions{maxDepth: defaultMaxDepth}
+
 // Holds the parser state.
 type selfParser struct {
+	decodeOptions
 	input      string
+	base       int // Offset of the input in the stream.
 	pos        int
 	lineNumber uint
+	column     uint
+	byteColumn uint
 	r          rune
 	runeWidth  int
 	eod        bool
+	depth      int
+	err        error // Set when the stream cannot be decoded further.
+	reachedEnd bool  // Whether the end of the input was looked at, so that more data could change the result.
 }
 
 // Generic type function for parsing selfValue.
 type parseFunc func() (selfValue, error)
 
+// Prints a position as a line and column.
+func (pos Position) String() string {
+	return fmt.Sprintf("line %d, column %d", pos.Line, pos.Column)
+}
+
+// Panic value raised when decoding reaches a state which no input should lead to.
+// It is recovered by the functions of the package API and reported as an error.
+type internalError struct {
+	message string
+}
+
+// Raises an internal error.
+func internalErrorf(format string, args ...interface{}) {
+	panic(internalError{fmt.Sprintf(format, args...)})
+}
+
 // Error printing.
 func (err *parserError) Error() string {
-	return fmt.Sprintf("Error while parsing self-ml: %s (line %d)", err.message, err.lineNumber)
+	return fmt.Sprintf("Error while parsing self-ml: %s (%s)", err.message, err.pos)
+}
+
+// Gets the position where the error occurred.
+func (err *parserError) Position() Position {
+	return err.pos
 }
 
 // Error generator.
 func (p *selfParser) newError(str string) error {
-	return &parserError{message: str, lineNumber: p.lineNumber}
+	return &parserError{message: str, pos: p.position()}
 }
 
 // Error generator.
-// Overrides current line number of parser.
-func (p *selfParser) newErrorAtLine(str string, lineNum uint) error {
-	return &parserError{message: str, lineNumber: lineNum}
+// Overrides current position of parser.
+func (p *selfParser) newErrorAt(str string, pos Position) error {
+	return &parserError{message: str, pos: pos}
+}
+
+// Gets the current position of the parser in the stream.
+func (p *selfParser) position() Position {
+	return Position{Offset: p.base + p.pos, Line: p.lineNumber, Column: p.column, ByteColumn: p.byteColumn}
 }
 
 // Getter for the real string value of a selfString.
@@ -83,14 +153,72 @@ func (s selfString) String() string {
 	return s.str
 }
 
+// Checks whether a string can be dumped without quotes.
+func isBareString(str string) bool {
+	if strings.HasPrefix(str, "<<") || strings.ContainsAny(str, " "+whiteSpaces+"\"#;([])") {
+		return false
+	}
+
+	for _, r := range str {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Encloses a string between double quotes, escaping special and non-printable characters.
+func quoteString(str string) string {
+	buf := make([]byte, 0, len(str)+2)
+	buf = append(buf, '"')
+	for _, r := range str {
+		switch r {
+		case '\\':
+			buf = append(buf, `\\`...)
+		case '"':
+			buf = append(buf, `\"`...)
+		case '\f':
+			buf = append(buf, `\f`...)
+		case '\r':
+			buf = append(buf, `\r`...)
+		case '\t':
+			buf = append(buf, `\t`...)
+		case '\n':
+			buf = append(buf, `\n`...)
+		case 0:
+			buf = append(buf, `\0`...)
+		case 0x1b:
+			buf = append(buf, `\e`...)
+		default:
+			if r == ' ' || unicode.IsPrint(r) {
+				buf = append(buf, string(r)...)
+			} else if r < 0x100 {
+				buf = append(buf, fmt.Sprintf(`\x%02X`, r)...)
+			} else if r < 0x10000 {
+				buf = append(buf, fmt.Sprintf(`\u%04X`, r)...)
+			} else {
+				buf = append(buf, fmt.Sprintf(`\U%08X`, r)...)
+			}
+		}
+	}
+	return string(append(buf, '"'))
+}
+
 // Converts a selfString into a printable string.
-func (s selfString) Dump(_ int) string {
+func (s selfString) Dump(indent int) string {
+	var buf strings.Builder
+	s.dump(&buf, indent)
+	return buf.String()
+}
+
+// Writes a selfString in a printable form.
+func (s selfString) dump(buf *strings.Builder, _ int) {
 	if len(s.str) == 0 {
-		return "[]"
-	} else if strings.ContainsAny(s.str, whiteSpaces+"\"#;([])") {
-		return "\"" + strings.Replace(s.str, "\"", "\"\"", -1) + "\""
+		buf.WriteString("[]")
+	} else if !isBareString(s.str) {
+		buf.WriteString(quoteString(s.str))
 	} else {
-		return s.str
+		buf.WriteString(s.str)
 	}
 }
 
@@ -101,28 +229,47 @@ func (node selfNode) isRoot() bool {
 }
 
 // Converts a selfNode into a printable string with indentation.
-func (node selfNode) Dump(indent int) (str string) {
-	// Root node needs no delimitors
-	if !node.isRoot() {
-		str = string(sexprOpen) + node.head.Dump(indent)
-	} else {
-		indent -= 1
-	}
+// Lists only made of strings are printed on a single line.
+func (node selfNode) Dump(indent int) string {
+	var buf strings.Builder
+	node.dump(&buf, indent)
+	return buf.String()
+}
 
-	if len(node.values) > 0 {
+// Writes a selfNode in a printable form with indentation.
+// Values are written into a single buffer, as concatenating the strings of
+// nested lists takes a time quadratic in the size of the document.
+func (node selfNode) dump(buf *strings.Builder, indent int) {
+	// Root node needs no delimitors
+	if node.isRoot() {
 		for _, v := range node.values {
-			str += "\n" + strings.Repeat("    ", indent+1) + v.Dump(indent+1)
-			if node.isRoot() {
-				str += "\n"
-			}
+			v.dump(buf, indent)
+			buf.WriteByte('\n')
 		}
+		return
 	}
 
-	if !node.isRoot() {
-		str += string(sexprClose)
+	multiline := false
+	for _, v := range node.values {
+		if _, ok := v.(*selfNode); ok {
+			multiline = true
+		}
 	}
 
-	return
+	buf.WriteByte(sexprOpen)
+	node.head.dump(buf, indent)
+	for _, v := range node.values {
+		if multiline {
+			buf.WriteByte('\n')
+			for i := 0; i <= indent; i++ {
+				buf.WriteString("    ")
+			}
+		} else {
+			buf.WriteByte(' ')
+		}
+		v.dump(buf, indent+1)
+	}
+	buf.WriteByte(sexprClose)
 }
 
 func (node *selfNode) getNodeByName(name string) *selfNode {
@@ -141,18 +288,69 @@ func (node *selfNode) getNodeByName(name string) *selfNode {
 // Decode the next rune in the stream.
 func (p *selfParser) next() {
 	p.pos += p.runeWidth
+	if p.r == endOfLine {
+		p.lineNumber++
+		p.column, p.byteColumn = 1, 1
+	} else {
+		p.column++
+		p.byteColumn += uint(p.runeWidth)
+	}
+
+	p.decodeRune()
+}
+
+// Decodes the rune at the current position of the input.
+func (p *selfParser) decodeRune() {
 	if p.pos >= len(p.input) {
-		p.eod = true
+		p.eod, p.reachedEnd = true, true
+		p.r, p.runeWidth = 0, 0
 		return
 	}
 
-	if p.r == endOfLine {
-		p.lineNumber++
+	// A valid U+FFFD character is decoded with a width of 3 bytes.
+	p.r, p.runeWidth = utf8.DecodeRuneInString(p.input[p.pos:])
+	if p.r == utf8.RuneError && p.runeWidth == 1 && !p.replaceInvalidUTF8 {
+		if !utf8.FullRuneInString(p.input[p.pos:]) {
+			p.reachedEnd = true
+		}
+		p.fail(p.newError("invalid UTF-8 encoding"))
+	}
+}
+
+// Returns the rune following the current one, without moving in the stream.
+func (p *selfParser) peek() rune {
+	if p.eod {
+		return 0
+	}
+
+	rest := p.input[p.pos+p.runeWidth:]
+	if !utf8.FullRuneInString(rest) {
+		p.reachedEnd = true
+	}
+	r, _ := utf8.DecodeRuneInString(rest)
+	return r
+}
+
+// Replaces the invalid UTF-8 sequences of a slice of the input with U+FFFD,
+// one per byte as done when decoding runes. Invalid sequences are only found
+// in the input when the replaceInvalidUTF8 option is set, the parser failing otherwise.
+func (p *selfParser) sanitize(str string) string {
+	if !p.replaceInvalidUTF8 || utf8.ValidString(str) {
+		return str
 	}
 
-	if p.r, p.runeWidth = utf8.DecodeRuneInString(p.input[p.pos:]); p.r == utf8.RuneError {
-		panic("bad rune")
+	var valid strings.Builder
+	for _, r := range str {
+		valid.WriteRune(r)
 	}
+	return valid.String()
+}
+
+// Stops the parser on an error which cannot be reported to the caller directly.
+func (p *selfParser) fail(err error) {
+	p.err = err
+	p.eod = true
+	p.r, p.runeWidth = 0, 0
 }
 
 func isComment(r rune) bool {
@@ -183,128 +381,461 @@ func (p *selfParser) skipLine() {
 	}
 }
 
+// Move after the end of a block comment, which can be nested.
+func (p *selfParser) skipBlockComment() {
+	start := p.position()
+	level := 0
+
+	for !p.eod {
+		if p.r == '#' && p.peek() == '|' {
+			level++
+			p.next()
+		} else if p.r == '|' && p.peek() == '#' {
+			level--
+			p.next()
+		}
+		p.next()
+
+		if level == 0 {
+			return
+		}
+	}
+
+	p.fail(p.newErrorAt("unexpected end of data in block comment", start))
+}
+
+// Move after the value commented out by a datum comment.
+func (p *selfParser) skipDatum() {
+	var err error
+	if p.r == sexprOpen {
+		_, err = p.parseNode()
+	} else {
+		_, err = p.parseString()
+	}
+
+	if err != nil {
+		p.fail(err)
+	}
+}
+
 // Skip any spaces, including comments, in the stream.
+// Datum comments are counted instead of being handled recursively, each
+// following value being commented out by a pending one, so that `#; #; a b`
+// comments out two values.
 func (p *selfParser) skipSpaces() {
-	for !p.eod && (isComment(p.r) || isSpace(p.r)) {
-		if isComment(p.r) {
+	var (
+		pending int
+		start   Position
+	)
+
+	for !p.eod {
+		if p.r == '#' && p.peek() == '|' {
+			p.skipBlockComment()
+		} else if p.r == '#' && p.peek() == ';' {
+			if pending == 0 {
+				start = p.position()
+			}
+			pending++
+			p.next()
+			p.next()
+		} else if isComment(p.r) {
 			p.skipLine()
+		} else if isSpace(p.r) {
+			p.next()
+		} else if pending > 0 && p.r != sexprClose {
+			p.skipDatum()
+			pending--
 		} else {
+			break
+		}
+	}
+
+	if pending > 0 && p.err == nil {
+		p.fail(p.newErrorAt("expected a value after datum comment", start))
+	}
+}
+
+// Checks whether the stream is positioned on a document separator.
+func (p *selfParser) atDocumentSeparator() bool {
+	if p.eod {
+		return false
+	} else if rest := p.input[p.pos:]; !strings.HasPrefix(rest, documentSeparator) {
+		if strings.HasPrefix(documentSeparator, rest) {
+			p.reachedEnd = true // The separator may be cut by the end of the input.
+		}
+		return false
+	}
+
+	rest := p.input[p.pos+len(documentSeparator):]
+	if !utf8.FullRuneInString(rest) {
+		p.reachedEnd = true
+	}
+	r, _ := utf8.DecodeRuneInString(rest)
+	return len(rest) == 0 || !isStringChar(r)
+}
+
+// Skips any document separators and spaces in the stream.
+// Empty documents are thus ignored.
+func (p *selfParser) skipDocumentSeparators() {
+	p.skipSpaces()
+	for p.atDocumentSeparator() {
+		for i := 0; i < len(documentSeparator); i++ {
 			p.next()
 		}
+		p.skipSpaces()
+	}
+}
+
+// Parses the hexadecimal digits of a \x, \u or \U escape sequence.
+// The parser is positioned on the escape letter and is moved after the last digit.
+func (p *selfParser) parseCodePointEscape(escapePos Position) (rune, error) {
+	var digits int
+	switch p.r {
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	}
+
+	seq := string(p.r)
+	for i := 0; i < digits; i++ {
+		p.next()
+		if p.eod || !strings.ContainsRune("0123456789abcdefABCDEF", p.r) {
+			return 0, p.newErrorAt("invalid escape sequence '\\"+seq+"'", escapePos)
+		}
+		seq += string(p.r)
 	}
+	p.next()
+
+	// Checked before the conversion, as rune(code) wraps to a negative value
+	// from 0x80000000.
+	code, err := strconv.ParseUint(seq[1:], 16, 32)
+	if err != nil {
+		internalErrorf("unchecked escape sequence '\\%s'", seq)
+	} else if code > unicode.MaxRune || (code >= 0xD800 && code <= 0xDFFF) {
+		return 0, p.newErrorAt("invalid code point in escape sequence '\\"+seq+"'", escapePos)
+	}
+	return rune(code), nil
 }
 
 // Parses a string value enclosed by a pair of double quotes.
-// Unescapes the following sequences: \r, \t, \n, \f, \\, \".
+// Unescapes the following sequences: \r, \t, \n, \f, \\, \", \0, \e,
+// \xHH, \uHHHH and \UHHHHHHHH. A backslash at the end of a line joins it
+// with the next one, without its leading white spaces.
+// Strings without escape sequences are sliced from the input, others are
+// built from the runs of characters between escape sequences.
 func (p *selfParser) parseEscapedString() (selfString, error) {
 
 	var (
-		str     string = ""
-		escape  bool   = false
-		lineNum uint   = p.lineNumber
+		str       strings.Builder
+		escaped   bool     = false
+		start     Position = p.position()
+		run       int      = p.pos // Start of the characters not yet written to str.
+		escapePos Position
 	)
 
-	for !p.eod {
-		if escape {
-			switch p.r {
-			case '\\':
-				str += "\\"
-			case 'f':
-				str += "\f"
-			case 'r':
-				str += "\r"
-			case 't':
-				str += "\t"
-			case 'n':
-				str += "\n"
-			case '"':
-				str += "\""
-			default:
-				return selfString{}, p.newErrorAtLine("invalid escape sequence '\\"+string(p.r)+"'", lineNum)
-			}
+	for !p.eod && p.r != '"' {
+		if err := p.checkStringLength(str.Len()+p.pos-run, start); err != nil {
+			return selfString{}, err
+		}
 
-			escape = false
+		if p.r != '\\' {
 			p.next()
 			continue
 		}
 
-		if p.r == '"' {
-			p.next()
-			break
-		}
+		escaped = true
+		escapePos = p.position()
+		str.WriteString(p.sanitize(p.input[run:p.pos]))
+		p.next()
 
-		if p.r == '\\' {
-			escape = true
-		} else {
-			str += string(p.r)
+		switch p.r {
+		case '\\':
+			str.WriteByte('\\')
+		case 'f':
+			str.WriteByte('\f')
+		case 'r':
+			str.WriteByte('\r')
+		case 't':
+			str.WriteByte('\t')
+		case 'n':
+			str.WriteByte('\n')
+		case '"':
+			str.WriteByte('"')
+		case '0':
+			str.WriteByte(0)
+		case 'e':
+			str.WriteByte(0x1b)
+		case 'x', 'u', 'U':
+			r, err := p.parseCodePointEscape(escapePos)
+			if err != nil {
+				return selfString{}, err
+			}
+			str.WriteRune(r)
+			run = p.pos
+			continue
+		case '\r', '\n':
+			if p.r == '\r' {
+				p.next()
+			}
+			if p.r == '\n' {
+				p.next()
+			}
+			for !p.eod && (p.r == ' ' || p.r == '\t') {
+				p.next()
+			}
+			run = p.pos
+			continue
+		default:
+			if p.eod {
+				return selfString{}, p.newErrorAt("unexpected end of data while parsing string", start)
+			}
+			return selfString{}, p.newErrorAt("invalid escape sequence '\\"+string(p.r)+"'", escapePos)
 		}
 
 		p.next()
+		run = p.pos
 	}
 
-	println(str)
-
 	if p.eod {
-		return selfString{}, p.newErrorAtLine("unexpected end of data while parsing string", lineNum)
-	} else {
-		return selfString{str: str, lineNumber: lineNum}, nil
+		return selfString{}, p.newErrorAt("unexpected end of data while parsing string", start)
+	} else if err := p.checkStringLength(str.Len()+p.pos-run, start); err != nil {
+		return selfString{}, err
+	}
+
+	value := p.sanitize(p.input[run:p.pos])
+	if escaped {
+		str.WriteString(value)
+		value = str.String()
 	}
+	p.next()
+	return selfString{str: value, pos: start, end: p.position()}, nil
 }
 
 // Parses a string enclosed into brackets.
 // Brackets are authorized inside the string as long as they're balanced.
 func (p *selfParser) parseBracketedString() (selfString, error) {
 	level := 1
-	str := ""
-	lineNum := p.lineNumber
+	start := p.position()
+	offset := p.pos
 
 	for !p.eod {
+		if err := p.checkStringLength(p.pos-offset, start); err != nil {
+			return selfString{}, err
+		}
+
 		if p.r == ']' {
 			level--
 			if level == 0 {
+				str := p.sanitize(p.input[offset:p.pos])
 				p.next()
-				break
+				return selfString{str: str, pos: start, end: p.position()}, nil
 			}
 		}
 
 		if p.r == '[' {
 			level++
 		}
+		p.next()
+	}
+
+	return selfString{}, p.newErrorAt("unexpected end of data while parsing string", start)
+}
 
-		str += string(p.r)
+// Gets the level of a raw string starting at the current position, that is
+// the number of `=` characters between its opening brackets.
+// Returns 0 if the stream is not positioned on a raw string.
+func (p *selfParser) rawStringLevel() int {
+	rest := p.input[p.pos:]
+	level := 1
+	for level < len(rest) && rest[level] == '=' {
+		level++
+	}
+
+	if level == 1 || level == len(rest) || rest[level] != '[' {
+		return 0
+	}
+	return level - 1
+}
+
+// Parses a raw string enclosed between `[=[` and `]=]`, with the same number
+// of `=` characters on both sides. The content is kept verbatim, except for a
+// newline immediately following the opening brackets.
+func (p *selfParser) parseRawString(level int) (selfString, error) {
+	start := p.position()
+	closing := "]" + strings.Repeat("=", level) + "]"
+	for i := 0; i < level+2; i++ {
 		p.next()
 	}
 
-	if p.eod {
-		return selfString{}, p.newErrorAtLine("unexpected end of data while parsing string", lineNum)
-	} else {
-		return selfString{str: str, lineNumber: lineNum}, nil
+	if p.r == '\r' && p.peek() == '\n' {
+		p.next()
+	}
+	if p.r == '\n' {
+		p.next()
+	}
+
+	offset := p.pos
+	for !p.eod {
+		if err := p.checkStringLength(p.pos-offset, start); err != nil {
+			return selfString{}, err
+		}
+
+		if strings.HasPrefix(p.input[p.pos:], closing) {
+			str := p.sanitize(p.input[offset:p.pos])
+			for i := 0; i < len(closing); i++ {
+				p.next()
+			}
+			return selfString{str: str, pos: start, end: p.position()}, nil
+		}
+		p.next()
+	}
+
+	return selfString{}, p.newErrorAt("unexpected end of data while parsing raw string", start)
+}
+
+// Gets the tag of a heredoc string starting at the current position.
+// The `<<` marker must be followed by the tag and the end of the line.
+// Returns an empty string if the stream is not positioned on a heredoc.
+func (p *selfParser) heredocTag() string {
+	rest := p.input[p.pos:]
+	if !strings.HasPrefix(rest, "<<") {
+		return ""
+	}
+
+	end := 2
+	for end < len(rest) && isTagChar(rest[end], end == 2) {
+		end++
+	}
+
+	tag := rest[2:end]
+	rest = strings.TrimLeft(rest[end:], " \t")
+	if len(tag) == 0 || !(strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n")) {
+		return ""
+	}
+	return tag
+}
+
+// Parses a heredoc string made of the lines following the `<<TAG` marker,
+// until a line holding TAG alone, possibly followed by the closing parentheses
+// of its lists. The indentation common to every non-blank line is stripped,
+// and each line is terminated by a newline.
+func (p *selfParser) parseHeredoc(tag string) (selfString, error) {
+	start := p.position()
+	p.skipLine()
+	p.next()
+
+	var (
+		lines  []string
+		length int
+		indent = -1
+	)
+
+	for !p.eod {
+		line := p.input[p.pos:]
+		if i := strings.IndexByte(line, endOfLine); i >= 0 {
+			line = line[:i]
+		} else {
+			p.reachedEnd = true
+		}
+
+		content := strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(content, tag) && strings.Trim(content[len(tag):], " \t\r)") == "" {
+			for i := 0; i < len(line)-len(content)+len(tag); i++ {
+				p.next()
+			}
+			return selfString{str: p.sanitize(stripIndent(lines, indent)), pos: start, end: p.position()}, nil
+		}
+
+		length += len(line) + 1
+		if err := p.checkStringLength(length, start); err != nil {
+			return selfString{}, err
+		}
+
+		line = strings.TrimSuffix(line, "\r")
+		if content = strings.TrimLeft(line, " \t"); len(content) > 0 {
+			if n := len(line) - len(content); indent < 0 || n < indent {
+				indent = n
+			}
+		}
+		lines = append(lines, line)
+
+		p.skipLine()
+		p.next()
 	}
+
+	return selfString{}, p.newErrorAt("unexpected end of data, heredoc is never terminated by `"+tag+"`", start)
 }
 
-func (p *selfParser) parseString() (selfString, error) {
-	var str string = ""
-	lineNum := p.lineNumber
+// Checks whether a character can be part of a heredoc tag.
+// Tags are made of ASCII letters, digits and underscores, and cannot start with a digit.
+func isTagChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// Joins the lines of a heredoc string after removing their common indentation.
+// Blank lines are emptied.
+func stripIndent(lines []string, indent int) string {
+	var str strings.Builder
+	for _, line := range lines {
+		if strings.TrimLeft(line, " \t") != "" {
+			str.WriteString(line[indent:])
+		}
+		str.WriteByte('\n')
+	}
+	return str.String()
+}
+
+// Checks whether a string being parsed exceeds the maximum length.
+func (p *selfParser) checkStringLength(length int, start Position) error {
+	if p.maxStringLength > 0 && length > p.maxStringLength {
+		return p.newErrorAt(fmt.Sprintf("string longer than %d bytes", p.maxStringLength), start)
+	}
+	return nil
+}
+
+func (p *selfParser) parseString() (s selfString, err error) {
+	start := p.position()
 
 	if p.eod {
 		return selfString{}, p.newError("unexpected end of data")
 	}
 
-	switch p.r {
-	case '"':
+	switch {
+	case p.r == '"':
 		p.next()
-		return p.parseEscapedString()
-	case '[':
+		s, err = p.parseEscapedString()
+	case p.r == '[' && p.rawStringLevel() > 0:
+		s, err = p.parseRawString(p.rawStringLevel())
+	case p.r == '[':
 		p.next()
-		return p.parseBracketedString()
+		s, err = p.parseBracketedString()
+	case p.r == '<' && p.heredocTag() != "":
+		s, err = p.parseHeredoc(p.heredocTag())
+	case p.r == ']':
+		return selfString{}, p.newError("unexpected `]` outside of a bracketed string")
 	default:
-		for isStringChar(p.r) {
-			str += string(p.r)
+		for !p.eod && isStringChar(p.r) {
+			if err = p.checkStringLength(p.base+p.pos-start.Offset, start); err != nil {
+				return
+			}
 			p.next()
 		}
+		s.str = p.sanitize(p.input[start.Offset-p.base : p.pos])
+		s.end = p.position()
 	}
 
-	return selfString{str: str, lineNumber: lineNum}, nil
+	if err != nil {
+		return
+	} else if err = p.checkStringLength(len(s.str), start); err != nil {
+		return selfString{}, err
+	}
+
+	s.pos = start
+	p.trace(TraceString, s.str, s.pos, s.end)
+	return
 }
 
 func (p *selfParser) parseNodeBody(rootNode bool) (values []selfValue, err error) {
@@ -320,6 +851,8 @@ func (p *selfParser) parseNodeBody(rootNode bool) (values []selfValue, err error
 			parseValue = func() (selfValue, error) { return p.parseNode() }
 		} else if !rootNode {
 			parseValue = func() (selfValue, error) { return p.parseString() }
+		} else if p.atDocumentSeparator() {
+			return
 		} else {
 			return nil, p.newError("Unexpected string in root node")
 		}
@@ -333,34 +866,45 @@ func (p *selfParser) parseNodeBody(rootNode bool) (values []selfValue, err error
 		p.skipSpaces()
 	}
 
-	if p.r == sexprClose {
-		p.next()
+	if rootNode && p.r == sexprClose {
+		return nil, p.newError("unexpected `)` in root node")
 	}
 
 	return
 }
 
 func (p *selfParser) parseNode() (node *selfNode, err error) {
-	var (
-		nodeName selfString
-		lineNum  = p.lineNumber
-	)
+	var nodeName selfString
 
 	p.skipSpaces()
+	start := p.position()
 	if p.r != sexprOpen {
 		return nil, p.newError("expected `(` token at start of list")
 	}
 	p.next()
 
+	if p.maxDepth > 0 && p.depth >= p.maxDepth {
+		return nil, p.newErrorAt(fmt.Sprintf("lists nested deeper than %d levels", p.maxDepth), start)
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+
 	nodeName, err = p.parseString()
 	if err != nil {
 		return nil, err
 	}
 
-	node = &selfNode{head: nodeName, lineNumber: lineNum}
+	node = &selfNode{head: nodeName, pos: start}
 	if node.values, err = p.parseNodeBody(false); err != nil {
 		return nil, err
 	}
 
+	if p.r != sexprClose {
+		return nil, p.newErrorAt("unexpected end of data, list is never closed", start)
+	}
+	p.next()
+	node.end = p.position()
+	p.trace(TraceList, node.head.str, node.pos, node.end)
+
 	return
 }
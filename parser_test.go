@@ -0,0 +1,332 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEscapeSequences(t *testing.T) {
+	valid := map[string]string{
+		`"a\tb"`:        "a\tb",
+		`"\x41"`:        "A",
+		`"é"`:           "é",
+		`"\U0001F600"`:  "\U0001F600",
+		`"\U0010FFFF"`:  "\U0010FFFF",
+		`"\0\e"`:        "\x00\x1b",
+		"\"a\\\n   b\"": "ab",
+	}
+	for input, expected := range valid {
+		var entry testEntry
+		if err := LoadString("(Name "+input+")", &entry); err != nil {
+			t.Errorf("%s: %v", input, err)
+		} else if entry.Name != expected {
+			t.Errorf("%s: got %q, expected %q", input, entry.Name, expected)
+		}
+	}
+
+	invalid := []string{
+		`"\q"`,
+		`"\x4"`,
+		`"\uD800"`,
+		`"\U00110000"`,
+		`"\U80000000"`,
+		`"\UFFFFFFFF"`,
+		`"abc\`,
+	}
+	for _, input := range invalid {
+		var entry testEntry
+		if err := LoadString("(Name "+input+")", &entry); err == nil {
+			t.Errorf("%s: accepted as %q", input, entry.Name)
+		} else if _, ok := err.(*parserError); !ok {
+			t.Errorf("%s: got %T, expected a parsing error", input, err)
+		}
+	}
+}
+
+func TestParseStrings(t *testing.T) {
+	inputs := map[string]string{
+		"(Name bare)":                       "bare",
+		"(Name [bracketed])":                "bracketed",
+		"(Name [a [nested] b])":             "a [nested] b",
+		"(Name [=[a ]] b]=])":               "a ]] b",
+		"(Name \"quoted ;#\")":              "quoted ;#",
+		"(Name []) ; comment":               "",
+		"#| block #| nested |# |# (Name x)": "x",
+		"#; (Name y) (Name x)":              "x",
+		"(Name #; ignored x)":               "x",
+		"(Name #; #; a b x)":                "x",
+		"(Name #; (nested) x)":              "x",
+		"\uFEFF(Name bom)":                  "bom",
+		"(Name <<EOF\n  a\n  b\n  EOF)":     "a\nb\n",
+	}
+	for input, expected := range inputs {
+		var entry testEntry
+		if err := LoadString(input, &entry); err != nil {
+			t.Errorf("%q: %v", input, err)
+		} else if entry.Name != expected {
+			t.Errorf("%q: got %q, expected %q", input, entry.Name, expected)
+		}
+	}
+}
+
+func TestDatumCommentErrors(t *testing.T) {
+	for _, input := range []string{"(Name x #;)", "(Name x) #;", "(Name #; #; x)"} {
+		var entry testEntry
+		if err := LoadString(input, &entry); err == nil {
+			t.Errorf("%q: accepted", input)
+		}
+	}
+}
+
+func TestManyDatumComments(t *testing.T) {
+	var entry testEntry
+	input := "(Name " + strings.Repeat("#; ", 8e6) + strings.Repeat("a ", 8e6) + "x)"
+	if err := LoadString(input, &entry); err != nil {
+		t.Fatal(err)
+	} else if entry.Name != "x" {
+		t.Errorf("got %q, expected x", entry.Name)
+	}
+
+	input = "(Name " + strings.Repeat("#; ", 8e6) + "x)"
+	if err := LoadString(input, &entry); err == nil {
+		t.Error("datum comments without values accepted")
+	}
+}
+
+func TestHeredoc(t *testing.T) {
+	inputs := map[string]string{
+		"(Name <<E\n  a\n\n    b\n  E)":    "a\n\n  b\n",
+		"(Name <<E\r\n  a\r\n  E\r\n)":     "a\n",
+		"(Name <<E\n  E1\n  EE\n  E )  \n": "E1\nEE\n",
+		"(Name <<END\n  BEGIN\n    x := 1;\n  END;\n  END IF;\n  END LOOP\n  select 1\n  END\n)": "BEGIN\n  x := 1;\nEND;\nEND IF;\nEND LOOP\nselect 1\n",
+	}
+	for input, expected := range inputs {
+		var entry testEntry
+		if err := LoadString(input, &entry); err != nil {
+			t.Errorf("%q: %v", input, err)
+		} else if entry.Name != expected {
+			t.Errorf("%q: got %q, expected %q", input, entry.Name, expected)
+		}
+	}
+
+	var conf fuzzConfig
+	if err := LoadString("(Nested (Ports <<E\n  1\n  E;\n  E))", &conf); err == nil {
+		t.Errorf("heredoc ended by `E;`, got ports %v", conf.Nested.Ports)
+	}
+	if err := LoadString("(Name <<E\n  a\n  E c)", &conf); err == nil {
+		t.Error("heredoc ended by a line holding more than its tag")
+	}
+}
+
+func TestHeredocInvalidUTF8(t *testing.T) {
+	input := "(Name <<E\n  a\xff\n  E)"
+
+	var entry testEntry
+	if err := LoadString(input, &entry); err == nil {
+		t.Errorf("invalid UTF-8 accepted as %q", entry.Name)
+	}
+
+	dec := NewDecoder(strings.NewReader(input))
+	dec.ReplaceInvalidUTF8()
+	if err := dec.Decode(&entry); err != nil {
+		t.Fatal(err)
+	} else if entry.Name != "a\uFFFD\n" {
+		t.Errorf("got %q, expected %q", entry.Name, "a\uFFFD\n")
+	}
+}
+
+// Strings of the parsing benchmarks, with and without escape sequences.
+var benchmarkStrings = []struct {
+	name  string
+	value func(size int) string
+}{
+	{"bare", func(size int) string { return strings.Repeat("a", size) }},
+	{"quoted", func(size int) string { return `"` + strings.Repeat("a b ", size/4) + `"` }},
+	{"escaped", func(size int) string { return `"` + strings.Repeat(`a\tb`, size/4) + `"` }},
+	{"bracketed", func(size int) string { return "[" + strings.Repeat("a [b] ", size/6) + "]" }},
+}
+
+// Parses documents of 1, 4 and 16 MB, made of a single long string or of many
+// short ones, parsing time being expected to grow linearly with their size.
+func BenchmarkParse(b *testing.B) {
+	for _, size := range []int{1 << 20, 4 << 20, 16 << 20} {
+		for _, str := range benchmarkStrings {
+			long := "(Name " + str.value(size) + ")"
+
+			var short strings.Builder
+			line := "(Name " + str.value(32) + ")\n"
+			for short.Len() < size {
+				short.WriteString(line)
+			}
+
+			for _, doc := range []struct{ shape, data string }{{"long", long}, {"short", short.String()}} {
+				name := fmt.Sprintf("%s/%s/%dMB", str.name, doc.shape, size>>20)
+				b.Run(name, func(b *testing.B) {
+					b.SetBytes(int64(len(doc.data)))
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						if _, err := Parse(doc.data); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	input := "(Név été)\n  (日本 \"語\" ok) ; ü\n(\tx)"
+	expected := []struct {
+		text, source string
+		pos, end     Position
+	}{
+		{"Név", "(Név été)", Position{0, 1, 1, 1}, Position{12, 1, 10, 13}},
+		{"été", "été", Position{6, 1, 6, 7}, Position{11, 1, 9, 12}},
+		{"日本", "(日本 \"語\" ok)", Position{15, 2, 3, 3}, Position{32, 2, 14, 20}},
+		{"語", "\"語\"", Position{23, 2, 7, 11}, Position{28, 2, 10, 16}},
+		{"ok", "ok", Position{29, 2, 11, 17}, Position{31, 2, 13, 19}},
+		{"", "(\tx)", Position{38, 3, 1, 1}, Position{42, 3, 5, 5}},
+		{"x", "x", Position{40, 3, 3, 3}, Position{41, 3, 4, 4}},
+	}
+
+	root, err := Parse(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nodes []Node
+	var walk func(n Node)
+	walk = func(n Node) {
+		nodes = append(nodes, n)
+		for _, v := range n.Values() {
+			walk(v)
+		}
+	}
+	for _, n := range root.Values() {
+		walk(n)
+	}
+
+	if len(nodes) != len(expected) {
+		t.Fatalf("got %d nodes, expected %d", len(nodes), len(expected))
+	}
+	for i, n := range nodes {
+		e := expected[i]
+		if text := n.Head() + n.Text(); text != e.text {
+			t.Errorf("node %d: got %q, expected %q", i, text, e.text)
+		} else if n.Pos() != e.pos || n.End() != e.end {
+			t.Errorf("%q: got %#v to %#v, expected %#v to %#v", text, n.Pos(), n.End(), e.pos, e.end)
+		} else if source := input[e.pos.Offset:e.end.Offset]; source != e.source {
+			t.Errorf("%q: offsets give %q, expected %q", text, source, e.source)
+		}
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   Position
+	}{
+		{"(Név \"é\\q\")", Position{9, 1, 8, 10}},
+		{"(a\n  (日本 [x)", Position{14, 2, 8, 12}},
+		{"(ü)\n)", Position{5, 2, 1, 1}},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.input)
+		if perr, ok := err.(*parserError); !ok {
+			t.Errorf("%q: got %v, expected a parsing error", test.input, err)
+		} else if pos := perr.Position(); pos != test.pos {
+			t.Errorf("%q: got %#v, expected %#v", test.input, pos, test.pos)
+		}
+	}
+}
+
+func TestInvalidUTF8Positions(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   Position
+	}{
+		{"(Name a\xffb)", Position{7, 1, 8, 8}},
+		{"(\xfe x)", Position{1, 1, 2, 2}},
+		{"(é\n  \xc3)", Position{6, 2, 3, 3}},
+		{"(Name \"é\xe2\x82\")", Position{9, 1, 9, 10}},
+		{"(Name [a\xff])", Position{8, 1, 9, 9}},
+		{"; \xff\n(Name x)", Position{2, 1, 3, 3}},
+		{"(Name x)\n---\n(Name é\xff)", Position{21, 3, 8, 9}},
+	}
+
+	for _, test := range tests {
+		dec := NewDecoder(strings.NewReader(test.input))
+		var err error
+		for err == nil {
+			err = dec.Decode(&testEntry{})
+		}
+
+		var perr *parserError
+		if !errors.As(err, &perr) || perr.message != "invalid UTF-8 encoding" {
+			t.Errorf("%q: got %v, expected an invalid UTF-8 error", test.input, err)
+		} else if pos := perr.Position(); pos != test.pos {
+			t.Errorf("%q: got %#v, expected %#v", test.input, pos, test.pos)
+		}
+	}
+
+	// Replaced bytes count as one column each.
+	var doc struct {
+		Name  string
+		Other RawNode
+	}
+	dec := NewDecoder(strings.NewReader("(Name a\xff\xfeb) (Other é)"))
+	dec.ReplaceInvalidUTF8()
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatal(err)
+	} else if doc.Name != "a\uFFFD\uFFFDb" {
+		t.Errorf("got %q", doc.Name)
+	} else if pos := doc.Other.Pos(); pos != (Position{12, 1, 13, 13}) {
+		t.Errorf("got %#v", pos)
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   Position
+		err   string
+	}{
+		{"\uFEFF(Name x)", Position{3, 1, 1, 1}, ""},
+		{"\uFEFF\n  (Name x)", Position{6, 2, 3, 3}, ""},
+		{"\uFEFF\uFEFF(Name x)", Position{3, 1, 1, 1}, "Unexpected string in root node"},
+		{"(Name x)\n\uFEFF(Other y)", Position{9, 2, 1, 1}, "Unexpected string in root node"},
+		{"\uFEFF(Name \xff)", Position{9, 1, 7, 7}, "invalid UTF-8 encoding"},
+	}
+
+	for _, test := range tests {
+		root, err := Parse(test.input)
+		if test.err != "" {
+			if perr, ok := err.(*parserError); !ok || perr.message != test.err {
+				t.Errorf("%q: got %v, expected %q", test.input, err, test.err)
+			} else if pos := perr.Position(); pos != test.pos {
+				t.Errorf("%q: got %#v, expected %#v", test.input, pos, test.pos)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+		} else if pos := root.Values()[0].Pos(); pos != test.pos {
+			t.Errorf("%q: got %#v, expected %#v", test.input, pos, test.pos)
+		}
+	}
+
+	// Only the start of the stream may hold a byte order mark.
+	dec := NewDecoder(strings.NewReader("\uFEFF(Name a)\n---\n\uFEFF(Name b)"))
+	var entry testEntry
+	if err := dec.Decode(&entry); err != nil || entry.Name != "a" {
+		t.Errorf("got %q, %v", entry.Name, err)
+	} else if err = dec.Decode(&entry); err == nil || !strings.Contains(err.Error(), "Unexpected string in root node (line 3, column 1)") {
+		t.Errorf("got %v, expected an error at the second byte order mark", err)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Registry of the concrete types which can be selected by a list head when
+// packing into an interface.
+var registry = struct {
+	sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}{
+	types: make(map[string]reflect.Type),
+	names: make(map[reflect.Type]string),
+}
+
+// Registers the concrete type of value under its type name.
+// Lists headed by this name can then be packed into interfaces implemented by the type.
+func Register(value interface{}) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		panic("lsd: registering nil value")
+	}
+
+	name := t.Name()
+	if t.Kind() == reflect.Ptr {
+		name = t.Elem().Name()
+	}
+	RegisterName(name, value)
+}
+
+// Registers the concrete type of value under the given name.
+// Lists headed by this name can then be packed into interfaces implemented by the type.
+// Panics if the name or the type are already registered with a different counterpart.
+func RegisterName(name string, value interface{}) {
+	t := reflect.TypeOf(value)
+	if name == "" {
+		panic("lsd: registering type with an empty name")
+	} else if t == nil {
+		panic("lsd: registering nil value")
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if other, ok := registry.types[name]; ok && other != t {
+		panic("lsd: registering duplicate types for `" + name + "`: " + other.String() + " and " + t.String())
+	} else if other, ok := registry.names[t]; ok && other != name {
+		panic("lsd: registering duplicate names for " + t.String() + ": `" + other + "` and `" + name + "`")
+	}
+
+	registry.types[name] = t
+	registry.names[t] = name
+}
+
+// Gets the concrete type registered under a name.
+func registeredType(name string) (reflect.Type, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	t, ok := registry.types[name]
+	return t, ok
+}
+
+// Gets the name a type was registered under, either directly or as a pointer.
+func registeredName(t reflect.Type) (string, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	if name, ok := registry.names[t]; ok {
+		return name, true
+	} else if t.Kind() == reflect.Ptr {
+		name, ok = registry.names[t.Elem()]
+		return name, ok
+	} else {
+		name, ok = registry.names[reflect.PtrTo(t)]
+		return name, ok
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testShape interface {
+	Area() float64
+}
+
+type testCircle struct {
+	R float64
+}
+
+func (c testCircle) Area() float64 { return 3 * c.R * c.R }
+
+type testRect struct {
+	W, H float64
+}
+
+func (r *testRect) Area() float64 { return r.W * r.H }
+
+type testDrawing struct {
+	Background testShape
+	Shapes     []testShape
+}
+
+func init() {
+	RegisterName("Circle", testCircle{})
+	Register((*testRect)(nil))
+	Register(playerInfo{})
+}
+
+func TestRegisteredTypes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected testDrawing
+	}{
+		{"(Background (Circle 1))", testDrawing{Background: testCircle{1}}},
+		{"(Background (testRect (W 2) (H 3)))", testDrawing{Background: &testRect{2, 3}}},
+		{"(Shapes)", testDrawing{Shapes: []testShape{}}},
+		{
+			"(Shapes (Circle 1) (testRect 2 3) (Circle (R 0.5)))",
+			testDrawing{Shapes: []testShape{testCircle{1}, &testRect{2, 3}, testCircle{0.5}}},
+		},
+	}
+
+	for _, test := range tests {
+		var drawing testDrawing
+		if err := LoadString(test.input, &drawing); err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		} else if !reflect.DeepEqual(drawing, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v", test.input, drawing, test.expected)
+		}
+
+		out, err := Marshal(&drawing)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		// A nil slice is written as an empty one, hence the comparison of outputs.
+		var decoded testDrawing
+		if err = LoadBytes(out, &decoded); err != nil {
+			t.Errorf("%s: %v in:\n%s", test.input, err, out)
+		} else if again, _ := Marshal(&decoded); string(again) != string(out) {
+			t.Errorf("%s: got:\n%s\nexpected:\n%s", test.input, again, out)
+		}
+	}
+}
+
+func TestRegisteredTypesErrors(t *testing.T) {
+	errors := map[string]string{
+		"(Background (Square 1))":                         "unknown type `Square`",
+		"(Shapes (Circle 1) (Triangle 1))":                "unknown type `Triangle`",
+		"(Background (playerInfo a 1 2))":                 "type `playerInfo` does not implement lsd.testShape",
+		"(Background (testRect x 2))":                     "cannot convert value `x` to type float64",
+		"(Shapes (testRect 1 2 3))":                       "too many values",
+		"(Background (Circle 1) (Circle 2))":              "bad number of values for interface field `Background`",
+		"(Background (Circle 1)) (Background (Circle 2))": "duplicate field `Background`",
+	}
+
+	for input, message := range errors {
+		var drawing testDrawing
+		err := LoadString(input, &drawing)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: got %v, expected %q", input, err, message)
+		}
+	}
+}
+
+func TestRegisterConflicts(t *testing.T) {
+	for name, register := range map[string]func(){
+		"same name":  func() { RegisterName("Circle", testRect{}) },
+		"same type":  func() { RegisterName("Disc", testCircle{}) },
+		"empty name": func() { RegisterName("", testCircle{}) },
+		"nil value":  func() { Register(nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: registering did not panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+
+	// Registering the same pair again is allowed.
+	RegisterName("Circle", testCircle{})
+}
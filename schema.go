@@ -0,0 +1,616 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gdelugre/lsd/internal/naming"
+)
+
+// Schema describes the lists allowed in LSD documents: their heads, the number
+// and types of their values, and how they nest.
+//
+// A schema is itself an LSD document, each top-level list describing a
+// top-level list of the documents by its head:
+//
+//	(Port (type uint16) (required yes))
+//	(AddressFamily (enum any inet inet6))
+//	(HostKey (count 1 *) (repeated yes))
+//	(Users (items
+//	    (head - User)
+//	    (fields
+//	        (UserName (required yes))
+//	        (Admin (type bool)))))
+type Schema struct {
+	root *schemaRule
+}
+
+// Constraints applying to a list of a document and to its values.
+type schemaRule struct {
+	name     string
+	typName  string
+	typ      reflect.Type // Type of the string values, nil for any string.
+	enum     []string
+	pattern  *regexp.Regexp
+	counted  bool // Whether the number of values is constrained.
+	min, max int  // Bounds of the number of values, max is negative if unbounded.
+	required bool
+	repeated bool
+	any      bool                   // Whether the values are left unchecked.
+	open     bool                   // Whether nested lists not described by fields are allowed.
+	ordered  bool                   // Whether the values can also be given in the order of the fields.
+	indexed  bool                   // Whether the items can also be lists headed by their index.
+	heads    []string               // Allowed heads of the lists given as items, nil for any head.
+	fields   map[string]*schemaRule // Rules of the nested lists, by head.
+	order    []string               // Heads of the fields, in definition order.
+	items    *schemaRule            // Rule of every value, whatever their head.
+	entries  *schemaRule            // Rule of every nested list, headed by a key.
+	keys     *schemaRule            // Rule of the keys heading the entries.
+}
+
+// Types of string values which can be checked by a schema.
+var schemaTypes = map[string]reflect.Type{
+	"string":     reflect.TypeOf(""),
+	"bool":       reflect.TypeOf(false),
+	"int":        reflect.TypeOf(int(0)),
+	"int8":       reflect.TypeOf(int8(0)),
+	"int16":      reflect.TypeOf(int16(0)),
+	"int32":      reflect.TypeOf(int32(0)),
+	"int64":      reflect.TypeOf(int64(0)),
+	"uint":       reflect.TypeOf(uint(0)),
+	"uint8":      reflect.TypeOf(uint8(0)),
+	"uint16":     reflect.TypeOf(uint16(0)),
+	"uint32":     reflect.TypeOf(uint32(0)),
+	"uint64":     reflect.TypeOf(uint64(0)),
+	"float":      reflect.TypeOf(float64(0)),
+	"float32":    reflect.TypeOf(float32(0)),
+	"float64":    reflect.TypeOf(float64(0)),
+	"complex":    reflect.TypeOf(complex128(0)),
+	"complex64":  reflect.TypeOf(complex64(0)),
+	"complex128": reflect.TypeOf(complex128(0)),
+	"size":       byteSizeType,
+	"ratio":      ratioType,
+}
+
+// Error type that can be triggered while reading a schema.
+type schemaError struct {
+	message string
+	pos     Position
+}
+
+// Error printing.
+func (err *schemaError) Error() (str string) {
+	str = fmt.Sprintf("Error in schema: %s", err.message)
+	if err.pos.Line != 0 {
+		str += fmt.Sprintf(" (%s)", err.pos)
+	}
+	return
+}
+
+// Gets the position of the faulty schema value.
+func (err *schemaError) Position() Position {
+	return err.pos
+}
+
+// ValidationError reports a value of a document which does not follow a schema.
+type ValidationError struct {
+	Message string
+	Pos     Position
+}
+
+// Error printing.
+func (err *ValidationError) Error() (str string) {
+	str = err.Message
+	if err.Pos.Line != 0 {
+		str += fmt.Sprintf(" (%s)", err.Pos)
+	}
+	return
+}
+
+// Gets the position of the faulty value.
+func (err *ValidationError) Position() Position {
+	return err.Pos
+}
+
+// ValidationErrors lists every violation of a schema found in a document, in
+// document order.
+type ValidationErrors []*ValidationError
+
+// Error printing, one violation per line.
+func (errs ValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Parses a schema from a string.
+func ParseSchema(data string) (*Schema, error) {
+	doc, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &schemaRule{name: "root", fields: make(map[string]*schemaRule)}
+	if err = root.parseFields(doc.value.(*selfNode)); err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+// Parses a schema file on disk.
+func LoadSchema(path string) (*Schema, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSchema(string(bytes))
+}
+
+// Generates an error for a schema value.
+func newSchemaError(v selfValue, str string) error {
+	return &schemaError{message: str, pos: v.Pos()}
+}
+
+// Gets the string values of a schema property, between min and max of them.
+func schemaStrings(prop *selfNode, min, max int) ([]string, error) {
+	name := prop.head.String()
+	if len(prop.values) < min || max >= 0 && len(prop.values) > max {
+		return nil, newSchemaError(prop, "bad number of values for property `"+name+"`")
+	}
+
+	strs := make([]string, len(prop.values))
+	for i, v := range prop.values {
+		str, ok := v.(selfString)
+		if !ok {
+			return nil, newSchemaError(v, "expected a string value for property `"+name+"`")
+		}
+		strs[i] = str.String()
+	}
+	return strs, nil
+}
+
+// Parses the rules of nested lists, each of them headed by the described head.
+func (rule *schemaRule) parseFields(node *selfNode) error {
+	for _, v := range node.values {
+		fieldNode, ok := v.(*selfNode)
+		if !ok {
+			return newSchemaError(v, "expected a list describing a field of `"+rule.name+"`")
+		}
+
+		name := fieldNode.head.String()
+		if _, ok := rule.fields[name]; ok {
+			return newSchemaError(fieldNode.head, "field `"+name+"` of `"+rule.name+"` described twice")
+		}
+
+		field := &schemaRule{name: name}
+		if err := field.parse(fieldNode); err != nil {
+			return err
+		} else if field.heads != nil {
+			return newSchemaError(fieldNode, "field `"+name+"` of `"+rule.name+"` is headed by its name, not by a constrained head")
+		}
+		rule.fields[name] = field
+		rule.order = append(rule.order, name)
+	}
+	return nil
+}
+
+// Parses a rule from its properties, which are the values of a list.
+func (rule *schemaRule) parse(node *selfNode) (err error) {
+	for _, v := range node.values {
+		prop, ok := v.(*selfNode)
+		if !ok {
+			return newSchemaError(v, "expected a property list for `"+rule.name+"`")
+		}
+
+		var strs []string
+		switch prop.head.String() {
+		case "type":
+			if strs, err = schemaStrings(prop, 1, 1); err != nil {
+				return
+			}
+			if rule.typ, ok = schemaTypes[strs[0]]; !ok {
+				return newSchemaError(prop.values[0], "unknown type `"+strs[0]+"`")
+			}
+			rule.typName = strs[0]
+
+		case "enum":
+			if rule.enum, err = schemaStrings(prop, 1, -1); err != nil {
+				return
+			}
+
+		case "pattern":
+			if strs, err = schemaStrings(prop, 1, 1); err != nil {
+				return
+			}
+			if rule.pattern, err = regexp.Compile(strs[0]); err != nil {
+				return newSchemaError(prop.values[0], "invalid pattern: "+err.Error())
+			}
+
+		case "count":
+			if strs, err = schemaStrings(prop, 1, 2); err != nil {
+				return
+			}
+			if rule.min, err = strconv.Atoi(strs[0]); err != nil || rule.min < 0 {
+				return newSchemaError(prop.values[0], "invalid count `"+strs[0]+"`")
+			}
+
+			rule.max = rule.min
+			if len(strs) == 2 && strs[1] == "*" {
+				rule.max = -1
+			} else if len(strs) == 2 {
+				if rule.max, err = strconv.Atoi(strs[1]); err != nil || rule.max < rule.min {
+					return newSchemaError(prop.values[1], "invalid count `"+strs[1]+"`")
+				}
+			}
+			rule.counted = true
+
+		case "head":
+			if rule.heads, err = schemaStrings(prop, 1, -1); err != nil {
+				return
+			}
+
+		case "required", "repeated", "any", "open", "ordered", "indexed":
+			if strs, err = schemaStrings(prop, 1, 1); err != nil {
+				return
+			}
+			var b bool
+			if b, err = parseBoolEx(strs[0]); err != nil {
+				return newSchemaError(prop.values[0], "invalid boolean `"+strs[0]+"`")
+			}
+			switch prop.head.String() {
+			case "required":
+				rule.required = b
+			case "repeated":
+				rule.repeated = b
+			case "any":
+				rule.any = b
+			case "open":
+				rule.open = b
+			case "ordered":
+				rule.ordered = b
+			case "indexed":
+				rule.indexed = b
+			}
+
+		case "fields":
+			rule.fields = make(map[string]*schemaRule)
+			if err = rule.parseFields(prop); err != nil {
+				return
+			}
+
+		case "items":
+			rule.items = &schemaRule{name: rule.name}
+			if err = rule.items.parse(prop); err != nil {
+				return
+			}
+
+		case "entries":
+			rule.entries = &schemaRule{name: rule.name}
+			if err = rule.entries.parse(prop); err != nil {
+				return
+			}
+
+		case "keys":
+			rule.keys = &schemaRule{name: rule.name}
+			if err = rule.keys.parse(prop); err != nil {
+				return
+			}
+
+		default:
+			return newSchemaError(prop.head, "unknown property `"+prop.head.String()+"`")
+		}
+	}
+
+	nested := 0
+	if rule.fields != nil {
+		nested++
+	}
+	if rule.items != nil {
+		nested++
+	}
+	if rule.entries != nil {
+		nested++
+	}
+
+	if nested > 1 {
+		return newSchemaError(node, "`"+rule.name+"` can only have one of fields, items and entries")
+	} else if (rule.fields != nil || rule.entries != nil) && (rule.typ != nil || rule.enum != nil || rule.pattern != nil) {
+		return newSchemaError(node, "`"+rule.name+"` with nested lists cannot constrain string values")
+	} else if rule.keys != nil && rule.entries == nil {
+		return newSchemaError(node, "`"+rule.name+"` cannot have keys without entries")
+	} else if rule.ordered && rule.fields == nil {
+		return newSchemaError(node, "`"+rule.name+"` cannot be ordered without fields")
+	} else if rule.indexed && rule.items == nil {
+		return newSchemaError(node, "`"+rule.name+"` cannot be indexed without items")
+	} else if rule.entries != nil && rule.entries.heads != nil {
+		return newSchemaError(node, "entries of `"+rule.name+"` are headed by keys, not by a constrained head")
+	}
+	return nil
+}
+
+// Holds the violations found while validating a document.
+type validator struct {
+	errs ValidationErrors
+}
+
+// Records a violation.
+func (val *validator) report(v selfValue, str string) {
+	val.errs = append(val.errs, &ValidationError{Message: str, Pos: v.Pos()})
+}
+
+// Checks a document against a schema.
+// Returns nil if the document is valid, or ValidationErrors listing every violation.
+func Validate(doc Node, schema *Schema) error {
+	root, ok := doc.value.(*selfNode)
+	if !ok {
+		return &ValidationError{Message: "document is not a list", Pos: doc.Pos()}
+	}
+
+	val := &validator{}
+	val.validateList(root, schema.root)
+	if len(val.errs) > 0 {
+		return val.errs
+	}
+	return nil
+}
+
+// Checks a value of a document against a rule.
+func (val *validator) validateValue(v selfValue, rule *schemaRule) {
+	switch v := v.(type) {
+	case selfString:
+		val.validateString(v, rule)
+	case *selfNode:
+		val.validateList(v, rule)
+	}
+}
+
+// Checks a string value of a document against a rule.
+func (val *validator) validateString(str selfString, rule *schemaRule) {
+	if rule.any {
+		return
+	} else if rule.fields != nil || rule.entries != nil || rule.items != nil {
+		val.report(str, "unexpected string `"+str.String()+"` in `"+rule.name+"`, expected a list")
+		return
+	}
+
+	if rule.typ != nil {
+		if _, err := str.encodeScalarField(rule.typ, ""); err != nil {
+			val.report(str, err.(*packError).message)
+			return
+		}
+	}
+
+	if rule.enum != nil {
+		allowed := false
+		for _, value := range rule.enum {
+			allowed = allowed || value == str.String()
+		}
+		if !allowed {
+			val.report(str, "value `"+str.String()+"` of `"+rule.name+"` is not one of "+strings.Join(rule.enum, ", "))
+		}
+	}
+
+	if rule.pattern != nil && !rule.pattern.MatchString(str.String()) {
+		val.report(str, "value `"+str.String()+"` of `"+rule.name+"` does not match pattern `"+rule.pattern.String()+"`")
+	}
+}
+
+// Checks a list of a document against a rule.
+// Unless constrained otherwise, lists without fields or items hold a single string.
+func (val *validator) validateList(node *selfNode, rule *schemaRule) {
+	if rule.any {
+		return
+	}
+
+	min, max := rule.min, rule.max
+	if !rule.counted {
+		min, max = 0, -1
+		if rule.fields == nil && rule.items == nil && rule.entries == nil {
+			min, max = 1, 1
+		}
+	}
+
+	if count := len(node.values); count < min || max >= 0 && count > max {
+		var expected string
+		switch {
+		case min == max:
+			expected = strconv.Itoa(min)
+		case max < 0:
+			expected = "at least " + strconv.Itoa(min)
+		default:
+			expected = fmt.Sprintf("between %d and %d", min, max)
+		}
+		val.report(node, fmt.Sprintf("bad number of values for `%s`: expected %s, got %d", node.head.String(), expected, count))
+	}
+
+	switch {
+	case rule.fields != nil && rule.ordered && rule.givenByOrder(node):
+		val.validateFieldsByOrder(node, rule)
+
+	case rule.fields != nil:
+		val.validateFields(node, rule)
+
+	case rule.items != nil && rule.indexed && node.isIndexed():
+		val.validateIndexedItems(node, rule)
+
+	case rule.items != nil:
+		for _, v := range node.values {
+			if item, ok := v.(*selfNode); ok && rule.items.heads != nil {
+				val.validateHead(item, node, rule.items)
+			}
+			val.validateValue(v, rule.items)
+		}
+
+	case rule.entries != nil:
+		val.validateEntries(node, rule)
+
+	default:
+		for _, v := range node.values {
+			if _, ok := v.(*selfNode); ok {
+				val.report(v, "unexpected list in `"+node.head.String()+"`, expected a string")
+			} else {
+				val.validateString(v.(selfString), rule)
+			}
+		}
+	}
+}
+
+// Gets the rule of the field matching a head, either exactly or with its first
+// letter capitalized like Load does by default.
+// Returns the head and a nil rule if no field matches.
+func (rule *schemaRule) lookupField(head string) (string, *schemaRule) {
+	if field, ok := rule.fields[head]; ok {
+		return head, field
+	} else if field, ok := rule.fields[naming.PublicName(head)]; ok {
+		return naming.PublicName(head), field
+	}
+	return head, nil
+}
+
+// Checks whether the values of a list are given in the order of the fields,
+// as done by Load when a value is a string or a list not headed by a field name.
+func (rule *schemaRule) givenByOrder(node *selfNode) bool {
+	for _, v := range node.values {
+		fieldNode, ok := v.(*selfNode)
+		if !ok {
+			return true
+		} else if _, field := rule.lookupField(fieldNode.head.String()); field == nil && !rule.open {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the values of a document list against the rules of the fields, in order.
+func (val *validator) validateFieldsByOrder(node *selfNode, rule *schemaRule) {
+	values := node.values
+	if len(values) > len(rule.order) {
+		val.report(node, fmt.Sprintf("too many values for `%s`: expected at most %d, got %d", node.head.String(), len(rule.order), len(values)))
+		values = values[:len(rule.order)]
+	}
+
+	for i, v := range values {
+		val.validateValue(v, rule.fields[rule.order[i]])
+	}
+
+	for _, name := range rule.order[len(values):] {
+		if rule.fields[name].required {
+			val.report(node, "missing required field `"+name+"` in `"+node.head.String()+"`")
+		}
+	}
+}
+
+// Checks the head of a list given as an item of a document list.
+func (val *validator) validateHead(item, node *selfNode, rule *schemaRule) {
+	head := item.head.String()
+	expected := make([]string, len(rule.heads))
+	for i, allowed := range rule.heads {
+		if naming.IsBulletPoint(allowed) && naming.IsBulletPoint(head) || allowed == head {
+			return
+		}
+
+		switch {
+		case naming.IsBulletPoint(allowed):
+			expected[i] = "a bullet point"
+		case allowed == "":
+			expected[i] = "[]"
+		default:
+			expected[i] = "`" + allowed + "`"
+		}
+	}
+	val.report(item.head, "unexpected head `"+head+"` in `"+node.head.String()+"`, expected "+strings.Join(expected, " or "))
+}
+
+// Checks the items of a document list given as lists headed by their index,
+// like the elements of an array.
+func (val *validator) validateIndexedItems(node *selfNode, rule *schemaRule) {
+	seen := make(map[uint64]Position)
+	for _, v := range node.values {
+		item := v.(*selfNode)
+		index, _ := strconv.ParseUint(item.head.String(), 10, 0)
+
+		if rule.counted && rule.max >= 0 && index >= uint64(rule.max) {
+			val.report(item.head, fmt.Sprintf("index %d out of range in `%s`, expected less than %d", index, node.head.String(), rule.max))
+		} else if first, ok := seen[index]; ok {
+			val.report(item.head, fmt.Sprintf("index %d repeated in `%s`, first defined at line %d", index, node.head.String(), first.Line))
+		} else {
+			seen[index] = item.Pos()
+		}
+		val.validateList(item, rule.items)
+	}
+}
+
+// Checks the nested lists of a document list against the rules of their heads.
+func (val *validator) validateFields(node *selfNode, rule *schemaRule) {
+	seen := make(map[string]Position)
+	for _, v := range node.values {
+		fieldNode, ok := v.(*selfNode)
+		if !ok {
+			val.report(v, "unexpected string `"+v.(selfString).String()+"` in `"+node.head.String()+"`, expected a list")
+			continue
+		}
+
+		name, field := rule.lookupField(fieldNode.head.String())
+		if field == nil {
+			if !rule.open {
+				val.report(fieldNode.head, "unknown field `"+name+"` in `"+node.head.String()+"`")
+			}
+			continue
+		}
+
+		if first, ok := seen[name]; ok && !field.repeated {
+			val.report(fieldNode, fmt.Sprintf("field `%s` repeated in `%s`, first defined at line %d", name, node.head.String(), first.Line))
+		} else if !ok {
+			seen[name] = fieldNode.Pos()
+		}
+		val.validateList(fieldNode, field)
+	}
+
+	var missing []string
+	for name, field := range rule.fields {
+		if _, ok := seen[name]; field.required && !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		val.report(node, "missing required field `"+name+"` in `"+node.head.String()+"`")
+	}
+}
+
+// Checks the nested lists of a document list, headed by unique keys, against
+// the rules of the entries and of the keys.
+func (val *validator) validateEntries(node *selfNode, rule *schemaRule) {
+	seen := make(map[string]Position)
+	for _, v := range node.values {
+		entry, ok := v.(*selfNode)
+		if !ok {
+			val.report(v, "unexpected string `"+v.(selfString).String()+"` in `"+node.head.String()+"`, expected a list")
+			continue
+		}
+
+		key := entry.head.String()
+		if first, ok := seen[key]; ok {
+			val.report(entry, fmt.Sprintf("key `%s` repeated in `%s`, first defined at line %d", key, node.head.String(), first.Line))
+		} else {
+			seen[key] = entry.Pos()
+		}
+
+		if rule.keys != nil {
+			val.validateString(entry.head, rule.keys)
+		}
+		val.validateList(entry, rule.entries)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type schemaMember struct {
+	Name string
+	Age  uint8
+}
+
+type schemaGroup struct {
+	Leader  schemaMember
+	Members []schemaMember
+	Pairs   [2]schemaMember
+	Grid    [][]int
+	Roles   map[string]schemaMember
+	Nested  []map[string]int
+	Fixed   [3]int `lsd:",exact"`
+	Comment string
+}
+
+type schemaConfig struct {
+	Group  schemaGroup
+	Groups []schemaGroup
+}
+
+// Documents accepted or rejected by Load, which Validate must agree with.
+var schemaDocs = []string{
+	"(Group (Leader (Name a) (Age 3)))",
+	"(Group (Leader a 3))",
+	"(Group (Leader a))",
+	"(Group (Leader a 3 4))",
+	"(Group (Leader a x))",
+	"(Group (Leader (Bogus a)))",
+	"(Group (Leader (Bogus a) 3))",
+	"(Group (Members (- a 3) (schemaMember b 4) (* (Name c))))",
+	"(Group (Members (Bogus a 3)))",
+	"(Group (Members (Bogus (Name a))))",
+	"(Group (Members a))",
+	"(Group (Pairs (- a 1) (- b 2)))",
+	"(Group (Pairs (- a 1) (- b 2) (- c 3)))",
+	"(Group (Pairs (0 a 1) (1 (Name b))))",
+	"(Group (Pairs (1 a 1) (1 b 2)))",
+	"(Group (Pairs (2 a 1)))",
+	"(Group (Pairs (Bogus a 1)))",
+	"(Group (Grid ([] 1 2) ([] 3)))",
+	"(Group (Grid (- 1 2)))",
+	"(Group (Grid (x 1)))",
+	"(Group (Roles (admin a 3) (user (Name b))))",
+	"(Group (Roles (admin (Bogus 1 2))))",
+	"(Group (Nested (- (a 1)) (Bogus (b 2))))",
+	"(Group (Fixed 1 2 3))",
+	"(Group (Fixed 1 2))",
+	"(Group (Fixed (0 1) (1 2) (2 3)))",
+	"(Group (Fixed (0 1) (1 2)))",
+	"(Group (a 3) (Leader b))",
+	"(Groups (- (Leader a 1) (Comment x)) (- (Leader b 2)))",
+	"(Groups (- b))",
+	"(Groups (G (Members (Bogus 1 2))))",
+	"(Groups (- (Members (Bogus 1 2))))",
+	"(group (leader a 1) (members (- (name b))))",
+	"(Group (Leader (Name a) (Name b)))",
+	"(Group (Grid a))",
+	"(Group (Comment (x)))",
+}
+
+// Checks a document with Load and Validate, which must agree.
+func checkSchemaAgreement(t *testing.T, schema *Schema, doc string) {
+	parsed, err := Parse(doc)
+	if err != nil {
+		return
+	}
+
+	loadErr := LoadString(doc, &schemaConfig{})
+	validateErr := Validate(parsed, schema)
+	if (loadErr == nil) != (validateErr == nil) {
+		t.Errorf("%s: Load returned %v, Validate returned %v", doc, loadErr, validateErr)
+	}
+}
+
+func TestSchemaAgreesWithLoad(t *testing.T) {
+	schema, err := SchemaFor(reflect.TypeOf(schemaConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, doc := range schemaDocs {
+		if _, err := Parse(doc); err != nil {
+			t.Fatalf("%s: %v", doc, err)
+		}
+		checkSchemaAgreement(t, schema, doc)
+	}
+}
+
+func FuzzSchemaAgreesWithLoad(f *testing.F) {
+	for _, doc := range schemaDocs {
+		f.Add(doc)
+	}
+
+	schema, err := SchemaFor(reflect.TypeOf(schemaConfig{}))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, doc string) {
+		checkSchemaAgreement(t, schema, doc)
+	})
+}
+func TestSchemaFor(t *testing.T) {
+	schema, err := SchemaFor(reflect.TypeOf(schemaGroup{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	str := schema.String()
+	for _, expected := range []string{
+		"(Leader\n    (ordered yes)\n",
+		"(Members\n    (count 0 *)\n    (items\n        (head - schemaMember)\n        (ordered yes)\n",
+		"(Pairs\n    (count 0 2)\n    (indexed yes)\n",
+		"(Grid\n    (count 0 *)\n    (items\n        (head [])\n",
+		"(Fixed\n    (count 3 3)\n    (indexed yes)\n",
+	} {
+		if !strings.Contains(str, expected) {
+			t.Errorf("%q not found in:\n%s", expected, str)
+		}
+	}
+
+	parsed, err := ParseSchema(str)
+	if err != nil {
+		t.Fatal(err)
+	} else if parsed.String() != str {
+		t.Errorf("schema changed when read back:\n%s", parsed)
+	}
+
+	if _, err := schema.JSONSchema(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseSchemaErrors(t *testing.T) {
+	for _, input := range []string{
+		"(Name (head -))",
+		"(Name (ordered yes))",
+		"(Name (indexed yes))",
+		"(Map (entries (head -)))",
+		"(Name (fields (Sub (head -))))",
+	} {
+		if _, err := ParseSchema(input); err == nil {
+			t.Errorf("%s: accepted", input)
+		}
+	}
+}
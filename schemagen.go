@@ -0,0 +1,367 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/gdelugre/lsd/internal/naming"
+)
+
+// Builds the schema of the documents packed into a structure type, following
+// the same rules as Load. Structures are described by field name, in the form
+// written by Marshal.
+func SchemaFor(t reflect.Type) (*Schema, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("lsd: SchemaFor expects a struct type, not %s", t)
+	}
+
+	root := &schemaRule{name: "root"}
+	if err := root.describeStruct(t, map[reflect.Type]bool{}); err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+// Gets the schema type of the strings packed into a scalar type.
+func scalarTypeName(t reflect.Type, opts naming.TagOptions) string {
+	kind := t.Kind()
+	switch {
+	case kind >= reflect.Int && kind <= reflect.Uint64 && (opts.Contains("bytesize") || t == byteSizeType):
+		return "size"
+	case (kind == reflect.Float32 || kind == reflect.Float64) && (opts.Contains("ratio") || t == ratioType):
+		return "ratio"
+	case kind == reflect.Uintptr:
+		return "uint"
+	default:
+		return kind.String()
+	}
+}
+
+// Describes the values of a list packed into a Go type.
+// Types being described are marked as visited, and recursive occurrences are left unchecked.
+func (rule *schemaRule) describe(t reflect.Type, opts naming.TagOptions, visited map[reflect.Type]bool) error {
+	kind := t.Kind()
+
+	switch {
+	case t == rawNodeType || t == nodeType || kind == reflect.Interface || visited[t]:
+		rule.any = true
+
+	case isTextUnmarshaler(t):
+		// A single string, checked when packed.
+
+	case isByteSequence(t):
+		// A single encoded string, or no value for an empty slice.
+		if kind == reflect.Slice {
+			rule.counted, rule.min, rule.max = true, 0, 1
+		}
+
+	case isScalarKind(kind):
+		rule.typName = scalarTypeName(t, opts)
+		rule.typ = schemaTypes[rule.typName]
+
+	case isOrderedMap(t):
+		keyType, elemType := reflect.New(t).Interface().(orderedMap).mapTypes()
+		return rule.describeEntries(keyType, elemType, visited)
+
+	case kind == reflect.Struct:
+		rule.ordered = true
+		return rule.describeStruct(t, visited)
+
+	case kind == reflect.Slice || kind == reflect.Array:
+		rule.counted, rule.min, rule.max = true, 0, -1
+		if kind == reflect.Array {
+			rule.max, rule.indexed = t.Len(), true
+			if opts.Contains("exact") {
+				rule.min = t.Len()
+			}
+		}
+
+		rule.items = &schemaRule{name: rule.name, heads: itemHeads(t.Elem())}
+		visited[t] = true
+		defer delete(visited, t)
+		return rule.items.describe(t.Elem(), "", visited)
+
+	case kind == reflect.Map:
+		return rule.describeEntries(t.Key(), t.Elem(), visited)
+
+	default:
+		return fmt.Errorf("lsd: cannot describe field `%s` of kind %s", rule.name, kind)
+	}
+	return nil
+}
+
+// Gets the heads allowed for the lists packed into the elements of a slice or
+// an array, as checked by checkMetaHeader.
+func itemHeads(elemType reflect.Type) []string {
+	switch kind := elemType.Kind(); {
+	case elemType == rawNodeType:
+		return nil
+	case kind == reflect.Slice || kind == reflect.Array:
+		return []string{""}
+	case kind == reflect.Struct || kind == reflect.Map:
+		return []string{"-", elemType.Name()}
+	}
+	return nil
+}
+
+// Describes the fields of a structure type.
+func (rule *schemaRule) describeStruct(t reflect.Type, visited map[reflect.Type]bool) error {
+	visited[t] = true
+	defer delete(visited, t)
+
+	rule.fields = make(map[string]*schemaRule)
+	for _, f := range typeFields(t) {
+		field := &schemaRule{name: f.name}
+		if err := field.describe(t.FieldByIndex(f.index).Type, f.opts, visited); err != nil {
+			return err
+		}
+		rule.fields[f.name] = field
+		rule.order = append(rule.order, f.name)
+	}
+
+	_, rule.open = remainField(t)
+	return nil
+}
+
+// Describes the entries of a map type.
+func (rule *schemaRule) describeEntries(keyType, elemType reflect.Type, visited map[reflect.Type]bool) error {
+	rule.entries = &schemaRule{name: rule.name}
+	if err := rule.entries.describe(elemType, "", visited); err != nil {
+		return err
+	}
+
+	if isScalarKind(keyType.Kind()) && !isTextUnmarshaler(keyType) {
+		rule.keys = &schemaRule{name: rule.name}
+		return rule.keys.describe(keyType, "", visited)
+	}
+	return nil
+}
+
+// Prints the schema in LSD syntax.
+func (schema *Schema) String() string {
+	root := selfNode{root: true, head: selfString{str: "root"}, values: schema.root.fieldNodes()}
+	return root.Dump(0)
+}
+
+// Builds the lists describing the fields of a rule, in definition order.
+func (rule *schemaRule) fieldNodes() (values []selfValue) {
+	for _, name := range rule.order {
+		values = append(values, rule.fields[name].node(name))
+	}
+	return
+}
+
+// Builds the list holding the properties of a rule.
+func (rule *schemaRule) node(head string) *selfNode {
+	node := &selfNode{head: selfString{str: head}}
+	property := func(name string, values ...string) {
+		prop := &selfNode{head: selfString{str: name}}
+		for _, v := range values {
+			prop.values = append(prop.values, selfString{str: v})
+		}
+		node.values = append(node.values, prop)
+	}
+
+	if rule.heads != nil {
+		property("head", rule.heads...)
+	}
+	if rule.any {
+		property("any", "yes")
+	}
+	if rule.typName != "" {
+		property("type", rule.typName)
+	}
+	if rule.enum != nil {
+		property("enum", rule.enum...)
+	}
+	if rule.pattern != nil {
+		property("pattern", rule.pattern.String())
+	}
+	if rule.counted {
+		max := "*"
+		if rule.max >= 0 {
+			max = strconv.Itoa(rule.max)
+		}
+		property("count", strconv.Itoa(rule.min), max)
+	}
+	if rule.required {
+		property("required", "yes")
+	}
+	if rule.repeated {
+		property("repeated", "yes")
+	}
+	if rule.open {
+		property("open", "yes")
+	}
+	if rule.ordered {
+		property("ordered", "yes")
+	}
+	if rule.indexed {
+		property("indexed", "yes")
+	}
+	if rule.fields != nil {
+		node.values = append(node.values, &selfNode{head: selfString{str: "fields"}, values: rule.fieldNodes()})
+	}
+	if rule.keys != nil {
+		node.values = append(node.values, rule.keys.node("keys"))
+	}
+	if rule.items != nil {
+		node.values = append(node.values, rule.items.node("items"))
+	}
+	if rule.entries != nil {
+		node.values = append(node.values, rule.entries.node("entries"))
+	}
+	return node
+}
+
+// Returns the JSON Schema describing the JSON representation of documents:
+// lists described by fields or entries are objects indexed by head, lists of
+// several values are arrays, and strings are converted to the JSON type
+// matching their schema type.
+func (schema *Schema) JSONSchema() ([]byte, error) {
+	root := schema.root.jsonSchema()
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	return json.MarshalIndent(root, "", "  ")
+}
+
+// Gets the JSON type of strings of a schema type.
+func jsonType(typName string) string {
+	switch typName {
+	case "bool":
+		return "boolean"
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "size":
+		return "integer"
+	case "float", "float32", "float64", "ratio":
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// Builds the JSON Schema of the values of a list following a rule.
+func (rule *schemaRule) jsonSchema() map[string]interface{} {
+	schema := make(map[string]interface{})
+
+	switch {
+	case rule.any:
+		return schema
+
+	case rule.fields != nil:
+		properties := make(map[string]interface{})
+		var required []string
+		for _, name := range rule.order {
+			properties[name] = rule.fields[name].jsonSchema()
+			if rule.fields[name].required {
+				required = append(required, name)
+			}
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		schema["additionalProperties"] = rule.open
+		if required != nil {
+			schema["required"] = required
+		}
+
+		// Values given in the order of the fields form an array.
+		if rule.ordered {
+			prefixItems := make([]interface{}, len(rule.order))
+			for i, name := range rule.order {
+				prefixItems[i] = properties[name]
+			}
+			array := map[string]interface{}{"type": "array", "prefixItems": prefixItems, "items": false}
+			if len(required) > 0 {
+				array["minItems"] = len(rule.order) - rule.optionalTail()
+			}
+			return map[string]interface{}{"anyOf": []interface{}{schema, array}}
+		}
+		return schema
+
+	case rule.entries != nil:
+		schema["type"] = "object"
+		schema["additionalProperties"] = rule.entries.jsonSchema()
+		if rule.keys != nil && (rule.keys.enum != nil || rule.keys.pattern != nil) {
+			schema["propertyNames"] = rule.keys.jsonString()
+		}
+		return schema
+
+	case rule.items != nil:
+		schema["type"] = "array"
+		schema["items"] = rule.items.jsonSchema()
+
+		// Items headed by their index form an object.
+		if rule.indexed {
+			rule.jsonCount(schema)
+			object := map[string]interface{}{
+				"type":                 "object",
+				"patternProperties":    map[string]interface{}{"^[0-9]+$": schema["items"]},
+				"additionalProperties": false,
+			}
+			return map[string]interface{}{"anyOf": []interface{}{schema, object}}
+		}
+
+	default:
+		if !rule.counted || rule.min == 1 && rule.max == 1 {
+			return rule.jsonString()
+		}
+		schema["type"] = "array"
+		schema["items"] = rule.jsonString()
+	}
+
+	rule.jsonCount(schema)
+	return schema
+}
+
+// Sets the bounds of the number of items of a JSON array.
+func (rule *schemaRule) jsonCount(schema map[string]interface{}) {
+	if rule.counted {
+		if rule.min > 0 {
+			schema["minItems"] = rule.min
+		}
+		if rule.max >= 0 {
+			schema["maxItems"] = rule.max
+		}
+	}
+}
+
+// Gets the number of fields which can be left out at the end of values given
+// in the order of the fields, as they are not required.
+func (rule *schemaRule) optionalTail() (n int) {
+	for i := len(rule.order) - 1; i >= 0 && !rule.fields[rule.order[i]].required; i-- {
+		n++
+	}
+	return
+}
+
+// Builds the JSON Schema of a single string following a rule.
+func (rule *schemaRule) jsonString() map[string]interface{} {
+	if rule.any {
+		return map[string]interface{}{}
+	}
+	schema := map[string]interface{}{"type": jsonType(rule.typName)}
+
+	if rule.enum != nil {
+		enum := make([]interface{}, len(rule.enum))
+		for i, value := range rule.enum {
+			enum[i] = value
+			if rule.typ != nil {
+				if item, err := (selfString{str: value}).encodeScalarField(rule.typ, ""); err == nil {
+					enum[i] = item
+				}
+			}
+		}
+		schema["enum"] = enum
+	}
+	if rule.pattern != nil && jsonType(rule.typName) == "string" {
+		schema["pattern"] = rule.pattern.String()
+	}
+	if jsonType(rule.typName) == "integer" && rule.typName[0] == 'u' || rule.typName == "size" {
+		schema["minimum"] = 0
+	}
+	return schema
+}
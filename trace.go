@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Kind of step reported to a tracer.
+type TraceKind int
+
+const (
+	TraceString TraceKind = iota // A string value has been parsed.
+	TraceList                    // A list has been parsed.
+	TracePack                    // A value is being packed into a Go value.
+)
+
+// Event reported to a tracer during decoding.
+type TraceEvent struct {
+	Kind  TraceKind
+	Pos   Position
+	End   Position
+	Value string       // String value, or head of the list.
+	Field string       // Name of the packed field, if any.
+	Type  reflect.Type // Type of the packed Go value, for TracePack events.
+}
+
+// Callback receiving trace events.
+type Tracer func(TraceEvent)
+
+// Printable name of a trace kind.
+func (kind TraceKind) String() string {
+	switch kind {
+	case TraceString:
+		return "string"
+	case TraceList:
+		return "list"
+	case TracePack:
+		return "pack"
+	default:
+		return fmt.Sprintf("TraceKind(%d)", int(kind))
+	}
+}
+
+// Printable form of a trace event.
+func (ev TraceEvent) String() (str string) {
+	str = fmt.Sprintf("%s %q (%s)", ev.Kind, ev.Value, ev.Pos)
+	if ev.Kind == TracePack {
+		str += fmt.Sprintf(" into %s", ev.Type)
+		if ev.Field != "" {
+			str += " field " + ev.Field
+		}
+	}
+	return
+}
+
+// Reports a parsed value to the tracer, if any.
+func (p *selfParser) trace(kind TraceKind, value string, pos, end Position) {
+	if p.tracer != nil {
+		p.tracer(TraceEvent{Kind: kind, Pos: pos, End: end, Value: value})
+	}
+}
+
+// Reports a packed value to the tracer, if any.
+func (ps *packState) trace(v selfValue, value, name string, t reflect.Type) {
+	if ps.tracer != nil {
+		ps.tracer(TraceEvent{Kind: TracePack, Pos: v.Pos(), End: v.End(), Value: value, Field: name, Type: t})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Size in bytes, written with an optional unit suffix like "256MiB", "1.5GB" or "4k".
+// Plain integer fields can follow the same syntax with the bytesize tag option.
+type ByteSize uint64
+
+// Ratio, written either as a number like "0.25" or as a percentage like "25%".
+// Plain floating-point fields can follow the same syntax with the ratio tag option.
+type Ratio float64
+
+var (
+	byteSizeType = reflect.TypeOf(ByteSize(0))
+	ratioType    = reflect.TypeOf(Ratio(0))
+)
+
+// Multipliers of the size units, indexed by lower-case suffix.
+// SI units are powers of 1000, IEC units and single letters are powers of 1024.
+var sizeUnits = map[string]uint64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1e3, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1e6, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1e9, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1e12, "tib": 1 << 40,
+	"p": 1 << 50, "pb": 1e15, "pib": 1 << 50,
+	"e": 1 << 60, "eb": 1e18, "eib": 1 << 60,
+}
+
+// Units used when printing sizes, by decreasing multiplier.
+var sizeUnitNames = []string{"EiB", "EB", "PiB", "PB", "TiB", "TB", "GiB", "GB", "MiB", "MB", "KiB", "kB"}
+
+// Parses a size in bytes with an optional unit suffix.
+// The result must be a whole number of bytes fitting into bitSize bits.
+func parseByteSize(s string, bitSize int) (uint64, error) {
+	if bitSize == 0 {
+		bitSize = strconv.IntSize
+	}
+
+	i := len(s)
+	for i > 0 && (s[i-1] >= 'a' && s[i-1] <= 'z' || s[i-1] >= 'A' && s[i-1] <= 'Z') {
+		i--
+	}
+
+	number, unit := strings.TrimSpace(s[:i]), s[i:]
+	multiplier, ok := sizeUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, errors.New("unknown size unit `" + unit + "`")
+	}
+
+	var size uint64
+	if n, err := strconv.ParseUint(number, 10, 64); err == nil {
+		hi, lo := bits.Mul64(n, multiplier)
+		if hi != 0 {
+			return 0, errors.New("size out of range")
+		}
+		size = lo
+	} else if f, err := strconv.ParseFloat(number, 64); err == nil && f >= 0 {
+		f *= float64(multiplier)
+		if f >= math.Ldexp(1, 64) {
+			return 0, errors.New("size out of range")
+		} else if f != math.Trunc(f) {
+			return 0, errors.New("size is not a whole number of bytes")
+		}
+		size = uint64(f)
+	} else {
+		return 0, errors.New("invalid size")
+	}
+
+	if bitSize < 64 && size >= 1<<uint(bitSize) {
+		return 0, errors.New("size out of range")
+	}
+	return size, nil
+}
+
+// Prints a size in bytes with the largest unit dividing it.
+func formatByteSize(size uint64) string {
+	if size != 0 {
+		for _, unit := range sizeUnitNames {
+			if multiplier := sizeUnits[strings.ToLower(unit)]; size%multiplier == 0 {
+				return strconv.FormatUint(size/multiplier, 10) + unit
+			}
+		}
+	}
+	return strconv.FormatUint(size, 10)
+}
+
+// Parses a ratio written as a number or as a percentage.
+func parseRatio(s string, bitSize int) (float64, error) {
+	if strings.HasSuffix(s, "%") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s[:len(s)-1]), bitSize)
+		return f / 100, err
+	}
+	return strconv.ParseFloat(s, bitSize)
+}
+
+// Prints a ratio as the shortest percentage read back as the same number.
+// Ratios which no percentage gives back, like the largest ones, are printed as numbers.
+func formatRatio(f float64, bitSize int) string {
+	for prec := 1; prec <= 17; prec++ {
+		// The rounded percentage is printed again to drop the exponent forced by a low precision.
+		percent, _ := strconv.ParseFloat(strconv.FormatFloat(f*100, 'g', prec, bitSize), bitSize)
+		str := strconv.FormatFloat(percent, 'g', -1, bitSize) + "%"
+		if r, err := parseRatio(str, bitSize); err == nil && (r == f || bitSize == 32 && float32(r) == float32(f)) {
+			return str
+		}
+	}
+	return strconv.FormatFloat(f, 'g', -1, bitSize)
+}
+
+// Prints the size with the largest unit dividing it.
+func (size ByteSize) String() string {
+	return formatByteSize(uint64(size))
+}
+
+// Prints the ratio as a percentage.
+func (r Ratio) String() string {
+	return formatRatio(float64(r), 64)
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2013 Guillaume Delugré.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package lsd
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		bitSize int
+		size    uint64
+		err     string
+	}{
+		{"0", 64, 0, ""},
+		{"4096", 64, 4096, ""},
+		{"4k", 64, 4 << 10, ""},
+		{"4K", 64, 4 << 10, ""},
+		{"256MiB", 64, 256 << 20, ""},
+		{"256mib", 64, 256 << 20, ""},
+		{"1.5GB", 64, 1.5e9, ""},
+		{"1.5 MB", 64, 1.5e6, ""},
+		{"2kB", 64, 2000, ""},
+		{"3b", 64, 3, ""},
+		{"15EiB", 64, 15 << 60, ""},
+		{"1.5GiB", 64, 3 << 29, ""},
+		{"1e3", 64, 1000, ""},
+
+		{"255", 8, 255, ""},
+		{"256", 8, 0, "size out of range"},
+		{"63KiB", 16, 63 << 10, ""},
+		{"64KiB", 16, 0, "size out of range"},
+		{"3GiB", 32, 3 << 30, ""},
+		{"4GiB", 32, 0, "size out of range"},
+		{"16EiB", 64, 0, "size out of range"},
+		{"18446744073709551615", 64, math.MaxUint64, ""},
+		{"18446744073709551616", 64, 0, "size out of range"},
+		{"20EB", 64, 0, "size out of range"},
+		{"1.5b", 64, 0, "size is not a whole number of bytes"},
+		{"0.1k", 64, 0, "size is not a whole number of bytes"},
+		{"4XB", 64, 0, "unknown size unit `XB`"},
+		{"K", 64, 0, "invalid size"},
+		{"-1", 64, 0, "invalid size"},
+		{"-1k", 64, 0, "invalid size"},
+	}
+
+	for _, test := range tests {
+		size, err := parseByteSize(test.input, test.bitSize)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q (%d bits): got %d, %v, expected %q", test.input, test.bitSize, size, err, test.err)
+			}
+		} else if err != nil || size != test.size {
+			t.Errorf("%q (%d bits): got %d, %v, expected %d", test.input, test.bitSize, size, err, test.size)
+		}
+	}
+}
+
+func TestFormatByteSize(t *testing.T) {
+	tests := map[uint64]string{
+		0:              "0",
+		1:              "1",
+		1000:           "1kB",
+		1024:           "1KiB",
+		1500:           "1500",
+		256 << 20:      "256MiB",
+		1.5e9:          "1500MB",
+		3 << 29:        "1536MiB",
+		1 << 60:        "1EiB",
+		math.MaxUint64: "18446744073709551615",
+	}
+
+	for size, expected := range tests {
+		if str := formatByteSize(size); str != expected {
+			t.Errorf("%d: got %q, expected %q", size, str, expected)
+		}
+		if str := ByteSize(size).String(); str != expected {
+			t.Errorf("ByteSize(%d): got %q, expected %q", size, str, expected)
+		}
+	}
+}
+
+func TestByteSizeRoundTrip(t *testing.T) {
+	sizes := []uint64{0, 1, 999, 1000, 1023, 1024, 4 << 10, 256 << 20, 1.5e9, 3 << 29, 1e18, 15 << 60, math.MaxUint64}
+	for _, size := range sizes {
+		str := formatByteSize(size)
+		if back, err := parseByteSize(str, 64); err != nil || back != size {
+			t.Errorf("%d: %q read back as %d, %v", size, str, back, err)
+		}
+	}
+}
+
+type sizeFields struct {
+	U8  uint8  `lsd:",bytesize"`
+	U16 uint16 `lsd:",bytesize"`
+	U32 uint32 `lsd:",bytesize"`
+	U64 uint64 `lsd:",bytesize"`
+	I8  int8   `lsd:",bytesize"`
+	I16 int16  `lsd:",bytesize"`
+	I32 int32  `lsd:",bytesize"`
+	I64 int64  `lsd:",bytesize"`
+}
+
+func TestByteSizeFieldsOverflow(t *testing.T) {
+	valid := "(U8 255) (U16 63KiB) (U32 3GiB) (U64 15EiB) (I8 127) (I16 31KiB) (I32 1GiB) (I64 7EiB)"
+	expected := sizeFields{255, 63 << 10, 3 << 30, 15 << 60, 127, 31 << 10, 1 << 30, 7 << 60}
+
+	var fields sizeFields
+	if err := LoadString(valid, &fields); err != nil {
+		t.Fatal(err)
+	} else if fields != expected {
+		t.Errorf("got %+v, expected %+v", fields, expected)
+	}
+
+	for _, input := range []string{
+		"(U8 256)", "(U16 64KiB)", "(U32 4GiB)", "(U64 16EiB)",
+		"(I8 128)", "(I16 32KiB)", "(I32 2GiB)", "(I64 8EiB)",
+	} {
+		if err := LoadString(input, &sizeFields{}); err == nil || !strings.Contains(err.Error(), "cannot convert value") {
+			t.Errorf("%s: got %v, expected a conversion error", input, err)
+		}
+	}
+
+	out, err := Marshal(&expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded sizeFields
+	if err = LoadBytes(out, &decoded); err != nil {
+		t.Fatalf("%v in:\n%s", err, out)
+	} else if decoded != expected {
+		t.Errorf("got %+v, expected %+v", decoded, expected)
+	}
+}
+
+func TestMarshalNegativeByteSize(t *testing.T) {
+	for _, v := range []interface{}{
+		&struct {
+			Size int `lsd:",bytesize"`
+		}{-1},
+		&struct {
+			Size int8 `lsd:",bytesize"`
+		}{-128},
+	} {
+		if out, err := Marshal(v); err == nil || !strings.Contains(err.Error(), "cannot marshal negative size") {
+			t.Errorf("%+v: got %q, %v, expected a negative size error", v, out, err)
+		}
+	}
+}
+
+func TestParseRatio(t *testing.T) {
+	tests := []struct {
+		input   string
+		bitSize int
+		ratio   float64
+		err     bool
+	}{
+		{"0.25", 64, 0.25, false},
+		{"25%", 64, 0.25, false},
+		{"25 %", 64, 0.25, false},
+		{"7%", 64, 0.07, false},
+		{"150%", 64, 1.5, false},
+		{"-50%", 64, -0.5, false},
+		{"1e2%", 64, 1, false},
+		{"%", 64, 0, true},
+		{"a%", 64, 0, true},
+		{"1/4", 64, 0, true},
+		{"1e39%", 32, 0, true},
+		{"1e309%", 64, 0, true},
+	}
+
+	for _, test := range tests {
+		ratio, err := parseRatio(test.input, test.bitSize)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q (%d bits): got %v, expected an error", test.input, test.bitSize, ratio)
+			}
+		} else if err != nil || ratio != test.ratio {
+			t.Errorf("%q (%d bits): got %v, %v, expected %v", test.input, test.bitSize, ratio, err, test.ratio)
+		}
+	}
+}
+
+func TestFormatRatio(t *testing.T) {
+	tests := []struct {
+		ratio    float64
+		bitSize  int
+		expected string
+	}{
+		{0, 64, "0%"},
+		{0.25, 64, "25%"},
+		{0.07, 64, "7%"},
+		{0.29, 64, "29%"},
+		{0.57, 64, "57%"},
+		{1.1, 64, "110%"},
+		{-0.5, 64, "-50%"},
+		{1e-5, 64, "0.001%"},
+		{float64(float32(0.07)), 32, "7%"},
+		{float64(float32(0.29)), 32, "29%"},
+		{float64(float32(1) / 3), 32, "0.33333334"},
+		{math.Inf(1), 64, "+Inf%"},
+		{math.MaxFloat64, 64, "1.7976931348623157e+308"},
+	}
+
+	for _, test := range tests {
+		if str := formatRatio(test.ratio, test.bitSize); str != test.expected {
+			t.Errorf("%v (%d bits): got %q, expected %q", test.ratio, test.bitSize, str, test.expected)
+		}
+	}
+	if str := Ratio(0.07).String(); str != "7%" {
+		t.Errorf("Ratio(0.07): got %q, expected \"7%%\"", str)
+	}
+}
+
+func TestRatioRoundTrip(t *testing.T) {
+	ratios := []float64{0, 0.01, 0.07, 0.1, 0.29, 1.0 / 3, 2.0 / 3, 0.123456789, 1e-300, 5e-324, math.Pi, 1e300, math.MaxFloat64, math.Inf(-1)}
+	for _, ratio := range ratios {
+		str := formatRatio(ratio, 64)
+		if back, err := parseRatio(str, 64); err != nil || back != ratio {
+			t.Errorf("%v: %q read back as %v, %v", ratio, str, back, err)
+		}
+
+		ratio32 := float32(ratio)
+		str = formatRatio(float64(ratio32), 32)
+		if back, err := parseRatio(str, 32); err != nil || float32(back) != ratio32 {
+			t.Errorf("float32 %v: %q read back as %v, %v", ratio32, str, back, err)
+		}
+	}
+
+	type ratioFields struct {
+		Usage float32 `lsd:",ratio"`
+		Share Ratio
+		Load  []Ratio
+	}
+	expected := ratioFields{0.07, 0.29, []Ratio{1.0 / 3, 0.57, 1e-9}}
+	out, err := Marshal(&expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ratioFields
+	if err = LoadBytes(out, &decoded); err != nil {
+		t.Fatalf("%v in:\n%s", err, out)
+	} else if decoded.Usage != expected.Usage || decoded.Share != expected.Share || len(decoded.Load) != 3 ||
+		decoded.Load[0] != expected.Load[0] || decoded.Load[1] != expected.Load[1] || decoded.Load[2] != expected.Load[2] {
+		t.Errorf("got %+v, expected %+v in:\n%s", decoded, expected, out)
+	}
+	if !strings.Contains(string(out), "(Usage 7%)") || !strings.Contains(string(out), "(Share 29%)") || !strings.Contains(string(out), " 57% ") {
+		t.Errorf("unexpected ratios in:\n%s", out)
+	}
+}